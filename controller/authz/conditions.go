@@ -0,0 +1,97 @@
+package authz
+
+import (
+	"encoding/json"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// The management types for role templates and their bindings have no status, so conditions are kept as JSON in an
+	// annotation.
+	conditionsAnnotation = "io.cattle.status.conditions"
+
+	conditionRoleTemplatesResolved = "RoleTemplatesResolved"
+	conditionRoleTemplateValid     = "Valid"
+	conditionRoleAvailable         = "RoleAvailable"
+)
+
+type condition struct {
+	// Type of the condition.
+	Type string `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status v1.ConditionStatus `json:"status"`
+	// The last time this condition was updated.
+	LastUpdateTime string `json:"lastUpdateTime,omitempty"`
+	// Last time the condition transitioned from one status to another.
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+	// The reason for the condition's last transition.
+	Reason string `json:"reason,omitempty"`
+}
+
+func getConditions(objectMeta metav1.Object) []condition {
+	var conditions []condition
+	if value := objectMeta.GetAnnotations()[conditionsAnnotation]; value != "" {
+		// a malformed annotation is simply overwritten
+		json.Unmarshal([]byte(value), &conditions)
+	}
+	return conditions
+}
+
+// setCondition sets the condition in the object's annotations and reports whether anything changed. Conditions are only
+// touched when their status or reason changes so that writing them back doesn't cause an endless stream of updates.
+func setCondition(objectMeta metav1.Object, conditionType string, status v1.ConditionStatus, reason string) bool {
+	conditions := getConditions(objectMeta)
+	currTime := time.Now().UTC().Format(time.RFC3339)
+
+	pos := -1
+	for i, c := range conditions {
+		if c.Type == conditionType {
+			pos = i
+			break
+		}
+	}
+
+	if pos < 0 {
+		conditions = append(conditions, condition{
+			Type:               conditionType,
+			Status:             status,
+			LastUpdateTime:     currTime,
+			LastTransitionTime: currTime,
+			Reason:             reason,
+		})
+	} else {
+		c := conditions[pos]
+		if c.Status == status && c.Reason == reason {
+			return false
+		}
+		if c.Status != status {
+			c.LastTransitionTime = currTime
+		}
+		c.Status = status
+		c.Reason = reason
+		c.LastUpdateTime = currTime
+		conditions[pos] = c
+	}
+
+	value, err := json.Marshal(conditions)
+	if err != nil {
+		return false
+	}
+	annotations := objectMeta.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[conditionsAnnotation] = string(value)
+	objectMeta.SetAnnotations(annotations)
+	return true
+}
+
+func conditionFromError(err error) (v1.ConditionStatus, string) {
+	if err != nil {
+		return v1.ConditionFalse, err.Error()
+	}
+	return v1.ConditionTrue, ""
+}
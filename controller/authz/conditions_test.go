@@ -0,0 +1,180 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type ConditionsSuite struct{}
+
+var _ = check.Suite(&ConditionsSuite{})
+
+// fakeRTLister serves RoleTemplates from a map.
+type fakeRTLister map[string]*v3.RoleTemplate
+
+func (f fakeRTLister) List(namespace string, selector labels.Selector) ([]*v3.RoleTemplate, error) {
+	var rts []*v3.RoleTemplate
+	for _, rt := range f {
+		rts = append(rts, rt)
+	}
+	return rts, nil
+}
+
+func (f fakeRTLister) Get(namespace, name string) (*v3.RoleTemplate, error) {
+	if rt, ok := f[name]; ok {
+		return rt, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: "management.cattle.io", Resource: "roletemplates"}, name)
+}
+
+func roleTemplates(children map[string][]string) fakeRTLister {
+	lister := fakeRTLister{}
+	for name, names := range children {
+		lister[name] = &v3.RoleTemplate{
+			ObjectMeta:        metav1.ObjectMeta{Name: name},
+			RoleTemplateNames: names,
+		}
+	}
+	return lister
+}
+
+func (s *ConditionsSuite) TestGatherRolesFollowsIncludes(c *check.C) {
+	lister := roleTemplates(map[string][]string{
+		"admin":  {"edit", "view"},
+		"edit":   {"view"},
+		"view":   nil,
+		"unused": nil,
+	})
+	r := &roleHandler{rtLister: lister}
+
+	roles := map[string]*v3.RoleTemplate{}
+	c.Assert(r.gatherRoles(lister["admin"], roles), check.IsNil)
+	c.Assert(roles, check.HasLen, 3)
+	for _, name := range []string{"admin", "edit", "view"} {
+		c.Assert(roles[name], check.NotNil)
+	}
+}
+
+func (s *ConditionsSuite) TestGatherRolesDetectsCycle(c *check.C) {
+	lister := roleTemplates(map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+	})
+	r := &roleHandler{rtLister: lister}
+
+	err := r.gatherRoles(lister["a"], map[string]*v3.RoleTemplate{})
+	c.Assert(err, check.ErrorMatches, "role template cycle detected: a -> b -> c -> a")
+}
+
+func (s *ConditionsSuite) TestGatherRolesDetectsSelfInclude(c *check.C) {
+	lister := roleTemplates(map[string][]string{
+		"a": {"a"},
+	})
+	r := &roleHandler{rtLister: lister}
+
+	err := r.gatherRoles(lister["a"], map[string]*v3.RoleTemplate{})
+	c.Assert(err, check.ErrorMatches, "role template cycle detected: a -> a")
+}
+
+func (s *ConditionsSuite) TestGatherRolesReportsMissingChild(c *check.C) {
+	lister := roleTemplates(map[string][]string{
+		"a": {"b"},
+		"b": {"missing"},
+	})
+	r := &roleHandler{rtLister: lister}
+
+	err := r.gatherRoles(lister["a"], map[string]*v3.RoleTemplate{})
+	c.Assert(err, check.ErrorMatches, "couldn't get RoleTemplate missing included by b: .*not found")
+}
+
+func (s *ConditionsSuite) TestConditionRoundTripsThroughAnnotation(c *check.C) {
+	rt := &v3.RoleTemplate{ObjectMeta: metav1.ObjectMeta{Name: "a"}}
+
+	c.Assert(setCondition(rt, conditionRoleTemplateValid, v1.ConditionFalse, "cycle"), check.Equals, true)
+	c.Assert(rt.Annotations[conditionsAnnotation], check.Not(check.Equals), "")
+
+	conditions := getConditions(rt)
+	c.Assert(conditions, check.HasLen, 1)
+	c.Assert(conditions[0].Type, check.Equals, conditionRoleTemplateValid)
+	c.Assert(conditions[0].Status, check.Equals, v1.ConditionFalse)
+	c.Assert(conditions[0].Reason, check.Equals, "cycle")
+	c.Assert(conditions[0].LastTransitionTime, check.Not(check.Equals), "")
+	transition := conditions[0].LastTransitionTime
+
+	// setting the same status and reason again is not a change
+	c.Assert(setCondition(rt, conditionRoleTemplateValid, v1.ConditionFalse, "cycle"), check.Equals, false)
+
+	c.Assert(setCondition(rt, conditionRoleTemplatesResolved, v1.ConditionTrue, ""), check.Equals, true)
+	c.Assert(setCondition(rt, conditionRoleTemplateValid, v1.ConditionTrue, ""), check.Equals, true)
+	conditions = getConditions(rt)
+	c.Assert(conditions, check.HasLen, 2)
+	c.Assert(conditions[0].Status, check.Equals, v1.ConditionTrue)
+	c.Assert(conditions[0].Reason, check.Equals, "")
+	c.Assert(conditions[0].LastTransitionTime >= transition, check.Equals, true)
+	c.Assert(conditions[1].Type, check.Equals, conditionRoleTemplatesResolved)
+}
+
+func (s *ConditionsSuite) TestMalformedAnnotationIsOverwritten(c *check.C) {
+	rt := &v3.RoleTemplate{ObjectMeta: metav1.ObjectMeta{
+		Name:        "a",
+		Annotations: map[string]string{conditionsAnnotation: "{not json"},
+	}}
+	c.Assert(getConditions(rt), check.HasLen, 0)
+
+	c.Assert(setCondition(rt, conditionRoleTemplateValid, v1.ConditionTrue, ""), check.Equals, true)
+	c.Assert(getConditions(rt), check.HasLen, 1)
+}
+
+// fakeCRLister serves ClusterRoles from a map.
+type fakeCRLister map[string]*rbacv1.ClusterRole
+
+func (f fakeCRLister) List(namespace string, selector labels.Selector) ([]*rbacv1.ClusterRole, error) {
+	var roles []*rbacv1.ClusterRole
+	for _, role := range f {
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func (f fakeCRLister) Get(namespace, name string) (*rbacv1.ClusterRole, error) {
+	if role, ok := f[name]; ok {
+		return role, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: rbacv1.GroupName, Resource: "clusterroles"}, name)
+}
+
+func (s *ConditionsSuite) TestVerifyBuiltinRoles(c *check.C) {
+	r := &roleHandler{crLister: fakeCRLister{"view": clusterRole("view", nil)}}
+	roles := map[string]*v3.RoleTemplate{
+		"view":   {ObjectMeta: metav1.ObjectMeta{Name: "view"}, Builtin: true},
+		"custom": {ObjectMeta: metav1.ObjectMeta{Name: "custom"}},
+	}
+	c.Assert(r.verifyBuiltinRoles(roles), check.IsNil)
+
+	roles["cluster-admin"] = &v3.RoleTemplate{ObjectMeta: metav1.ObjectMeta{Name: "cluster-admin"}, Builtin: true}
+	c.Assert(r.verifyBuiltinRoles(roles), check.ErrorMatches,
+		"builtin role template cluster-admin has no matching ClusterRole in this cluster")
+}
+
+func (s *ConditionsSuite) TestRoleAvailableConditionIsPerCluster(c *check.C) {
+	rt := &v3.RoleTemplate{ObjectMeta: metav1.ObjectMeta{Name: "view"}, Builtin: true}
+	setCondition(rt, roleAvailableConditionType("c1"), v1.ConditionTrue, "")
+	setCondition(rt, roleAvailableConditionType("c2"), v1.ConditionFalse, "missing")
+
+	conditions := getConditions(rt)
+	c.Assert(conditions, check.HasLen, 2)
+	c.Assert(conditions[0].Type, check.Equals, "RoleAvailable/c1")
+	c.Assert(conditions[1].Type, check.Equals, "RoleAvailable/c2")
+	c.Assert(conditions[1].Status, check.Equals, v1.ConditionFalse)
+}
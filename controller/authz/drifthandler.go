@@ -0,0 +1,240 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/metrics"
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	eventReasonRepaired  = "BindingRepaired"
+	eventReasonRecreated = "BindingDeleted"
+)
+
+// watchOwnedBindings enqueues the owning ProjectRoleTemplateBinding or ClusterRoleTemplateBinding whenever one of the
+// role bindings created for it is changed or deleted, so changes made outside of the agent are reverted right away
+// instead of at the next resync. Replicas on standby don't know about the deletions the leader expects, so only the
+// elected replica watches.
+func (r *roleHandler) watchOwnedBindings(ctx context.Context) {
+	handler := cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			if utils.IsElected(ctx) {
+				r.enqueueBindingOwner(obj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if utils.IsElected(ctx) {
+				r.ownedBindingDeleted(obj)
+			}
+		},
+	}
+	r.workload.RBAC.RoleBindings("").Controller().Informer().AddEventHandler(handler)
+	r.workload.RBAC.ClusterRoleBindings("").Controller().Informer().AddEventHandler(handler)
+}
+
+func (r *roleHandler) ownedBindingDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	if r.deleteExpected(objMeta.GetNamespace(), objMeta.GetName()) {
+		return
+	}
+	if !r.enqueueBindingOwner(obj) {
+		return
+	}
+	if objMeta.GetNamespace() != "" {
+		if ns, err := r.nsLister.Get("", objMeta.GetNamespace()); err != nil || ns.DeletionTimestamp != nil {
+			return
+		}
+	}
+
+	kind := "ClusterRoleBinding"
+	if _, ok := obj.(*rbacv1.RoleBinding); ok {
+		kind = "RoleBinding"
+	}
+	r.recordEvent(kind, objMeta, v1.EventTypeWarning, eventReasonRecreated,
+		fmt.Sprintf("%v %v was deleted outside of the agent, restoring it", kind, objMeta.GetName()))
+}
+
+// enqueueBindingOwner enqueues the live owner of an agent owned role binding and reports whether one was found.
+func (r *roleHandler) enqueueBindingOwner(obj interface{}) bool {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	ownerUID := objMeta.GetLabels()[rtbOwnerLabel]
+	if ownerUID == "" {
+		return false
+	}
+
+	enqueued := false
+	if objs, err := r.crtbIndexer.ByIndex(crtbByUIDIndex, ownerUID); err == nil {
+		for _, obj := range objs {
+			if binding, ok := obj.(*v3.ClusterRoleTemplateBinding); ok && binding.DeletionTimestamp == nil {
+				r.crtbController.Enqueue("", binding.Name)
+				enqueued = true
+			}
+		}
+	}
+	if objs, err := r.prtbIndexer.ByIndex(prtbByUIDIndex, ownerUID); err == nil {
+		for _, obj := range objs {
+			if binding, ok := obj.(*v3.ProjectRoleTemplateBinding); ok && binding.DeletionTimestamp == nil {
+				r.prtbController.Enqueue("", binding.Name)
+				enqueued = true
+			}
+		}
+	}
+	return enqueued
+}
+
+// deleteBinding deletes a role binding with del, recording that the agent itself deletes it so the deletion isn't
+// reported as drift. When the delete fails, or the binding is already gone, no deletion is coming and the expectation is
+// dropped again.
+func (r *roleHandler) deleteBinding(ns, name string, del func(string, *metav1.DeleteOptions) error) error {
+	r.expectDelete(ns, name)
+	err := del(name, &metav1.DeleteOptions{})
+	if err != nil {
+		r.deleteExpected(ns, name)
+	}
+	return err
+}
+
+func (r *roleHandler) expectDelete(ns, name string) {
+	r.expectedDeletesLock.Lock()
+	defer r.expectedDeletesLock.Unlock()
+	r.expectedDeletes[ns+"/"+name] = true
+}
+
+func (r *roleHandler) deleteExpected(ns, name string) bool {
+	r.expectedDeletesLock.Lock()
+	defer r.expectedDeletesLock.Unlock()
+	key := ns + "/" + name
+	expected := r.expectedDeletes[key]
+	delete(r.expectedDeletes, key)
+	return expected
+}
+
+// bindingMatches compares the parts of a role binding the agent manages, taking the defaults applied by the apiserver
+// into account.
+func bindingMatches(subjects []rbacv1.Subject, roleRef rbacv1.RoleRef, actualSubjects []rbacv1.Subject, actualRoleRef rbacv1.RoleRef) bool {
+	if roleRef.Kind != actualRoleRef.Kind || roleRef.Name != actualRoleRef.Name {
+		return false
+	}
+	if len(subjects) != len(actualSubjects) {
+		return false
+	}
+	for i, subject := range subjects {
+		actual := actualSubjects[i]
+		if subject.Kind != actual.Kind || subject.Name != actual.Name || subject.Namespace != actual.Namespace {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *roleHandler) repairClusterBinding(existing *rbacv1.ClusterRoleBinding, objectMeta metav1.ObjectMeta, subjects []rbacv1.Subject, roleRef rbacv1.RoleRef) error {
+	bindingCli := r.workload.K8sClient.RbacV1().ClusterRoleBindings()
+	if existing.RoleRef.Kind != roleRef.Kind || existing.RoleRef.Name != roleRef.Name {
+		// roleRef is immutable, the binding has to be recreated
+		if err := r.deleteBinding("", existing.Name, bindingCli.Delete); err != nil {
+			return errors.Wrapf(err, "error deleting clusterrolebinding %v", existing.Name)
+		}
+		if _, err := bindingCli.Create(&rbacv1.ClusterRoleBinding{
+			ObjectMeta: objectMeta,
+			Subjects:   subjects,
+			RoleRef:    roleRef,
+		}); err != nil {
+			return errors.Wrapf(err, "couldn't create clusterrolebinding %v", existing.Name)
+		}
+	} else {
+		existing = existing.DeepCopy()
+		existing.Subjects = subjects
+		if _, err := bindingCli.Update(existing); err != nil {
+			return errors.Wrapf(err, "couldn't update clusterrolebinding %v", existing.Name)
+		}
+	}
+
+	r.recordEvent("ClusterRoleBinding", existing, v1.EventTypeWarning, eventReasonRepaired,
+		fmt.Sprintf("ClusterRoleBinding %v was modified outside of the agent, restored its subjects and role", existing.Name))
+	return nil
+}
+
+func (r *roleHandler) repairBinding(existing *rbacv1.RoleBinding, objectMeta metav1.ObjectMeta, subjects []rbacv1.Subject, roleRef rbacv1.RoleRef) error {
+	bindingCli := r.workload.K8sClient.RbacV1().RoleBindings(existing.Namespace)
+	if existing.RoleRef.Kind != roleRef.Kind || existing.RoleRef.Name != roleRef.Name {
+		// roleRef is immutable, the binding has to be recreated
+		if err := r.deleteBinding(existing.Namespace, existing.Name, bindingCli.Delete); err != nil {
+			return errors.Wrapf(err, "error deleting rolebinding %v", existing.Name)
+		}
+		if _, err := bindingCli.Create(&rbacv1.RoleBinding{
+			ObjectMeta: objectMeta,
+			Subjects:   subjects,
+			RoleRef:    roleRef,
+		}); err != nil {
+			return errors.Wrapf(err, "couldn't create rolebinding %v", existing.Name)
+		}
+	} else {
+		existing = existing.DeepCopy()
+		existing.Subjects = subjects
+		if _, err := bindingCli.Update(existing); err != nil {
+			return errors.Wrapf(err, "couldn't update rolebinding %v", existing.Name)
+		}
+	}
+
+	r.recordEvent("RoleBinding", existing, v1.EventTypeWarning, eventReasonRepaired,
+		fmt.Sprintf("RoleBinding %v was modified outside of the agent, restored its subjects and role", existing.Name))
+	return nil
+}
+
+func crtbByUID(obj interface{}) ([]string, error) {
+	binding, ok := obj.(*v3.ClusterRoleTemplateBinding)
+	if !ok {
+		return []string{}, nil
+	}
+	return []string{string(binding.UID)}, nil
+}
+
+func prtbByUID(obj interface{}) ([]string, error) {
+	binding, ok := obj.(*v3.ProjectRoleTemplateBinding)
+	if !ok {
+		return []string{}, nil
+	}
+	return []string{string(binding.UID)}, nil
+}
+
+// reportOwnedBindings publishes the number of role bindings the agent owns on /metrics, counted from the caches.
+func (r *roleHandler) reportOwnedBindings() {
+	selector, err := labels.Parse(rtbOwnerLabel)
+	if err != nil {
+		return
+	}
+	metrics.ManagedObjects.With("RoleBinding").SetFunc(func() float64 {
+		rbs, err := r.rbLister.List("", selector)
+		if err != nil {
+			return 0
+		}
+		return float64(len(rbs))
+	})
+	metrics.ManagedObjects.With("ClusterRoleBinding").SetFunc(func() float64 {
+		crbs, err := r.crbLister.List("", selector)
+		if err != nil {
+			return 0
+		}
+		return float64(len(crbs))
+	})
+}
@@ -0,0 +1,50 @@
+package authz
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	eventComponent = "cluster-agent"
+	// events about cluster scoped objects are recorded in the default namespace, like kubectl does
+	eventNamespace = "default"
+)
+
+// recordEvent records a Kubernetes Event in the cluster about the RBAC object of the given kind.
+func (r *roleHandler) recordEvent(kind string, objMeta metav1.Object, eventType, reason, message string) {
+	ns := objMeta.GetNamespace()
+	if ns == "" {
+		ns = eventNamespace
+	}
+
+	now := metav1.NewTime(time.Now())
+	_, err := r.workload.K8sClient.CoreV1().Events(ns).Create(&v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", objMeta.GetName(), now.UnixNano()),
+			Namespace: ns,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       kind,
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Name:       objMeta.GetName(),
+			Namespace:  objMeta.GetNamespace(),
+			UID:        objMeta.GetUID(),
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	})
+	if err != nil {
+		logrus.Warnf("Error recording event for %v %v: %v", kind, objMeta.GetName(), err)
+	}
+}
@@ -0,0 +1,76 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+const (
+	subjectKindAnnotation      = "io.cattle.rtb.subject.kind"
+	subjectNameAnnotation      = "io.cattle.rtb.subject.name"
+	subjectNamespaceAnnotation = "io.cattle.rtb.subject.namespace"
+
+	serviceAccountUserPrefix = "system:serviceaccount:"
+
+	// bindingNamePartLength caps the readable parts of a binding name, the hash keeps the name unique.
+	bindingNamePartLength = 40
+	bindingNameHashLength = 10
+)
+
+// bindingName returns the name of the role binding granting roleName to subject on behalf of the owner with the given
+// UID. Subject names may contain characters that aren't valid in object names (OIDC groups, email addresses,
+// service account user names) and may be arbitrarily long, so the name is made of sanitized, truncated parts followed
+// by a hash of the unmodified values. The inputs to the hash must not change, or every binding gets renamed on upgrade.
+func bindingName(roleName, ownerUID string, subject rbacv1.Subject) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{roleName, subject.Kind, subject.Namespace, subject.Name, ownerUID}, "\x00")))
+	suffix := hex.EncodeToString(hash[:])[:bindingNameHashLength]
+
+	var parts []string
+	for _, part := range []string{roleName, subject.Name} {
+		if part = sanitizeNamePart(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, suffix), "-")
+}
+
+// sanitizeNamePart lowercases s, replaces anything that isn't valid in a DNS subdomain with a dash and trims it to
+// bindingNamePartLength.
+func sanitizeNamePart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, s)
+	if len(s) > bindingNamePartLength {
+		s = s[:bindingNamePartLength]
+	}
+	return strings.Trim(s, "-")
+}
+
+// normalizeSubject fills in the API group expected for the subject's kind and turns a service account given by its
+// user name (system:serviceaccount:<namespace>:<name>) into a proper ServiceAccount subject.
+func normalizeSubject(subject rbacv1.Subject) rbacv1.Subject {
+	if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" && strings.HasPrefix(subject.Name, serviceAccountUserPrefix) {
+		if parts := strings.SplitN(strings.TrimPrefix(subject.Name, serviceAccountUserPrefix), ":", 2); len(parts) == 2 {
+			subject.Namespace = parts[0]
+			subject.Name = parts[1]
+		}
+	}
+
+	switch subject.Kind {
+	case rbacv1.UserKind, rbacv1.GroupKind:
+		subject.APIGroup = rbacv1.GroupName
+	case rbacv1.ServiceAccountKind:
+		subject.APIGroup = ""
+	}
+	return subject
+}
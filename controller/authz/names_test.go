@@ -0,0 +1,118 @@
+package authz
+
+import (
+	"gopkg.in/check.v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+type NamesSuite struct{}
+
+var _ = check.Suite(&NamesSuite{})
+
+// The expected names are fixed: bindings are looked up by name, so any change here renames every binding on upgrade.
+func (s *NamesSuite) TestBindingNamesAreStable(c *check.C) {
+	tests := []struct {
+		roleName string
+		ownerUID string
+		subject  rbacv1.Subject
+		expected string
+	}{
+		{
+			roleName: "edit",
+			ownerUID: "uid-1",
+			subject:  rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"},
+			expected: "edit-alice-d94bc3b9ce",
+		},
+		{
+			// the owner is part of the hash, two bindings granting the same role keep their own role bindings
+			roleName: "edit",
+			ownerUID: "uid-2",
+			subject:  rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"},
+			expected: "edit-alice-5a0daad94a",
+		},
+		{
+			roleName: "view",
+			ownerUID: "uid-1",
+			subject:  rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "oidc:Developers@Example.com"},
+			expected: "view-oidc-developers-example-com-9d3c9288ea",
+		},
+		{
+			roleName: "view",
+			ownerUID: "uid-2",
+			subject:  rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "a-very-long-group-name-from-an-identity-provider-that-goes-on-and-on"},
+			expected: "view-a-very-long-group-name-from-an-identity-ec31d2bb96",
+		},
+		{
+			roleName: "view",
+			ownerUID: "uid-1",
+			subject:  rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "::"},
+			expected: "view-2bcb8c725e",
+		},
+		{
+			roleName: "admin",
+			ownerUID: "uid-3",
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "system:serviceaccount:kube-system:deployer"},
+			expected: "admin-deployer-634d1f44ed",
+		},
+		{
+			// a service account given by namespace and name gets the same binding as the one given by its user name
+			roleName: "admin",
+			ownerUID: "uid-3",
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "kube-system", Name: "deployer"},
+			expected: "admin-deployer-634d1f44ed",
+		},
+	}
+
+	for _, test := range tests {
+		name, objectMeta, _, _ := bindingParts(test.roleName, test.ownerUID, test.subject)
+		c.Check(name, check.Equals, test.expected, check.Commentf("subject %v", test.subject))
+		c.Check(objectMeta.Name, check.Equals, test.expected)
+	}
+}
+
+func (s *NamesSuite) TestNormalizeSubject(c *check.C) {
+	tests := []struct {
+		subject  rbacv1.Subject
+		expected rbacv1.Subject
+	}{
+		{
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "system:serviceaccount:ns:name"},
+			expected: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "ns", Name: "name"},
+		},
+		{
+			// only the first colon after the namespace separates it from the name
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "system:serviceaccount:ns:name:with:colons"},
+			expected: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "ns", Name: "name:with:colons"},
+		},
+		{
+			// an explicit namespace wins over the user name form
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "other", Name: "system:serviceaccount:ns:name"},
+			expected: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "other", Name: "system:serviceaccount:ns:name"},
+		},
+		{
+			subject:  rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "system:serviceaccount:incomplete"},
+			expected: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "system:serviceaccount:incomplete"},
+		},
+		{
+			subject:  rbacv1.Subject{Kind: rbacv1.UserKind, Name: "system:serviceaccount:ns:name"},
+			expected: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccount:ns:name"},
+		},
+		{
+			subject:  rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "devs"},
+			expected: rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "devs"},
+		},
+	}
+
+	for _, test := range tests {
+		c.Check(normalizeSubject(test.subject), check.DeepEquals, test.expected)
+	}
+}
+
+func (s *NamesSuite) TestSanitizeNamePart(c *check.C) {
+	c.Check(sanitizeNamePart("Alice@Example.COM"), check.Equals, "alice-example-com")
+	c.Check(sanitizeNamePart("-leading-and-trailing-"), check.Equals, "leading-and-trailing")
+	// truncation may leave a dash at the end, which is trimmed
+	c.Check(sanitizeNamePart("0123456789012345678901234567890123456789-more"), check.Equals, "0123456789012345678901234567890123456789")
+	c.Check(sanitizeNamePart("012345678901234567890123456789012345678-more"), check.Equals, "012345678901234567890123456789012345678")
+	c.Check(sanitizeNamePart("日本"), check.Equals, "")
+}
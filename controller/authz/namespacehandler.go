@@ -0,0 +1,55 @@
+package authz
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// syncNamespace makes the RoleBindings owned by ProjectRoleTemplateBindings in the namespace match the project the
+// namespace currently belongs to. Bindings for the namespace's project are created and bindings left behind by a
+// project the namespace no longer belongs to are removed.
+func (r *roleHandler) syncNamespace(key string, ns *v1.Namespace) error {
+	if ns == nil || ns.DeletionTimestamp != nil {
+		return nil
+	}
+
+	desired := map[string]bool{}
+	if projectName := ns.Labels[projectIDLabel]; projectName != "" {
+		objs, err := r.prtbIndexer.ByIndex(prtbByProjectIndex, projectName)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get bindings for project %v", projectName)
+		}
+
+		for _, obj := range objs {
+			binding, ok := obj.(*v3.ProjectRoleTemplateBinding)
+			if !ok || binding.DeletionTimestamp != nil {
+				continue
+			}
+
+			roles, err := r.resolveRoles(binding.RoleTemplateName)
+			if err != nil {
+				return err
+			}
+
+			if err := r.ensureRoles(roles); err != nil {
+				return errors.Wrap(err, "couldn't ensure roles")
+			}
+
+			for _, role := range roles {
+				if err := r.ensureBinding(ns.Name, role.Name, binding); err != nil {
+					return errors.Wrapf(err, "couldn't ensure binding %v %v in %v", role.Name, binding.Subject.Name, ns.Name)
+				}
+				bindingName, _, _, _ := bindingParts(role.Name, string(binding.UID), binding.Subject)
+				desired[bindingName] = true
+			}
+		}
+	}
+
+	selector, err := labels.Parse(rtbOwnerLabel)
+	if err != nil {
+		return err
+	}
+	return r.pruneBindings(ns.Name, selector, desired)
+}
@@ -0,0 +1,339 @@
+package authz
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	typescorev1 "github.com/rancher/types/apis/core/v1"
+	typesextv1beta1 "github.com/rancher/types/apis/extensions/v1beta1"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	typesrbacv1 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	psptOwnerLabel   = "io.cattle.pspt.owner"
+	pspBindingLabel  = "io.cattle.psp.binding"
+	pspUseVerb       = "use"
+	pspRolePrefix    = "psp-"
+	pspBindingPrefix = "psp-"
+)
+
+// pspHandler materializes the PodSecurityPolicyTemplate selected for a project (or the cluster default) into a
+// PodSecurityPolicy in the cluster and grants every service account in the project's namespaces the right to use it.
+// All of the work is keyed off of namespaces, changes to projects, clusters and templates just enqueue the namespaces
+// they affect.
+type pspHandler struct {
+	workload      *config.ClusterContext
+	clusterLister v3.ClusterLister
+	projectLister v3.ProjectLister
+	psptLister    v3.PodSecurityPolicyTemplateLister
+	nsLister      typescorev1.NamespaceLister
+	nsController  typescorev1.NamespaceController
+	crLister      typesrbacv1.ClusterRoleLister
+	rbLister      typesrbacv1.RoleBindingLister
+	pspLister     typesextv1beta1.PodSecurityPolicyLister
+}
+
+func newPSPHandler(workload *config.ClusterContext) *pspHandler {
+	return &pspHandler{
+		workload:      workload,
+		clusterLister: workload.Management.Management.Clusters("").Controller().Lister(),
+		projectLister: workload.Management.Management.Projects("").Controller().Lister(),
+		psptLister:    workload.Management.Management.PodSecurityPolicyTemplates("").Controller().Lister(),
+		nsLister:      workload.Core.Namespaces("").Controller().Lister(),
+		nsController:  workload.Core.Namespaces("").Controller(),
+		crLister:      workload.RBAC.ClusterRoles("").Controller().Lister(),
+		rbLister:      workload.RBAC.RoleBindings("").Controller().Lister(),
+		pspLister:     workload.Extensions.PodSecurityPolicies("").Controller().Lister(),
+	}
+}
+
+func (p *pspHandler) syncCluster(key string, cluster *v3.Cluster) error {
+	if key != p.workload.ClusterName {
+		return nil
+	}
+	return p.enqueueNamespaces(labels.Everything())
+}
+
+func (p *pspHandler) syncProject(key string, project *v3.Project) error {
+	if project != nil && project.Spec.ClusterName != p.workload.ClusterName {
+		return nil
+	}
+	return p.enqueueNamespaces(labels.Set(map[string]string{projectIDLabel: key}).AsSelector())
+}
+
+func (p *pspHandler) syncTemplate(key string, template *v3.PodSecurityPolicyTemplate) error {
+	if template == nil {
+		if err := p.deletePSP(key); err != nil {
+			return err
+		}
+	} else if _, err := p.pspLister.Get("", template.Name); err == nil {
+		if _, err := p.ensurePSP(template); err != nil {
+			return err
+		}
+	}
+
+	// The set of namespaces using the template can't be determined from the template alone since it may be the
+	// cluster default, so let every namespace re-evaluate its binding.
+	return p.enqueueNamespaces(labels.Everything())
+}
+
+func (p *pspHandler) syncNamespace(key string, ns *v1.Namespace) error {
+	if ns == nil || ns.DeletionTimestamp != nil {
+		return nil
+	}
+
+	templateName, err := p.templateNameForProject(ns.Labels[projectIDLabel])
+	if err != nil {
+		return err
+	}
+
+	if templateName != "" {
+		template, err := p.psptLister.Get("", templateName)
+		if apierrors.IsNotFound(err) {
+			// the namespace is enqueued again if the template is recreated
+			logrus.Warnf("Pod security policy template [%s] of namespace [%s] not found, no policy applies", templateName, ns.Name)
+			return p.prunePSPBindings(ns.Name, "")
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get pod security policy template %v", templateName)
+		}
+
+		owned, err := p.ensurePSP(template)
+		if err != nil {
+			return err
+		}
+		if owned {
+			owned, err = p.ensurePSPRole(template.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if !owned {
+			// the policy or role of the template's name belongs to someone else, granting it would apply their policy
+			return p.prunePSPBindings(ns.Name, "")
+		}
+
+		if err := p.ensurePSPBinding(ns.Name, template.Name); err != nil {
+			return err
+		}
+	}
+
+	return p.prunePSPBindings(ns.Name, templateName)
+}
+
+// templateNameForProject returns the name of the PodSecurityPolicyTemplate that applies to the project. The project's
+// own template takes precedence over the cluster default, namespaces outside of any project get the cluster default.
+// An empty name means no policy applies.
+func (p *pspHandler) templateNameForProject(projectName string) (string, error) {
+	if projectName != "" {
+		project, err := p.projectLister.Get("", projectName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", errors.Wrapf(err, "couldn't get project %v", projectName)
+		}
+		if project != nil && project.Spec.PodSecurityPolicyTemplateName != "" {
+			return project.Spec.PodSecurityPolicyTemplateName, nil
+		}
+	}
+
+	cluster, err := p.clusterLister.Get("", p.workload.ClusterName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "couldn't get cluster %v", p.workload.ClusterName)
+	}
+	return cluster.Spec.DefaultPodSecurityPolicyTemplateName, nil
+}
+
+// ensurePSP creates or updates the PodSecurityPolicy of the template and reports whether it's owned by the template. A
+// policy of the same name that wasn't created for the template is left alone.
+func (p *pspHandler) ensurePSP(template *v3.PodSecurityPolicyTemplate) (bool, error) {
+	pspCli := p.workload.K8sClient.ExtensionsV1beta1().PodSecurityPolicies()
+	if psp, err := p.pspLister.Get("", template.Name); err == nil {
+		if psp.Labels[psptOwnerLabel] != template.Name {
+			logrus.Warnf("Pod security policy [%s] already exists and wasn't created for the template of the same name, leaving it alone", psp.Name)
+			return false, nil
+		}
+		if reflect.DeepEqual(psp.Spec, template.Spec) {
+			return true, nil
+		}
+		psp = psp.DeepCopy()
+		psp.Spec = template.Spec
+		if _, err := pspCli.Update(psp); err != nil {
+			return false, errors.Wrapf(err, "couldn't update pod security policy %v", template.Name)
+		}
+		return true, nil
+	}
+
+	_, err := pspCli.Create(&extv1beta1.PodSecurityPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   template.Name,
+			Labels: map[string]string{psptOwnerLabel: template.Name},
+		},
+		Spec: template.Spec,
+	})
+	if err != nil {
+		// a policy created in the meantime is checked when the namespace is retried
+		return false, errors.Wrapf(err, "couldn't create pod security policy %v", template.Name)
+	}
+	return true, nil
+}
+
+// ensurePSPRole creates or updates the ClusterRole granting use of the template's policy and reports whether it's owned
+// by the template. A role of the same name that wasn't created for the template is left alone.
+func (p *pspHandler) ensurePSPRole(templateName string) (bool, error) {
+	roleName := pspRoleName(templateName)
+	rules := []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{extv1beta1.GroupName},
+			Resources:     []string{"podsecuritypolicies"},
+			ResourceNames: []string{templateName},
+			Verbs:         []string{pspUseVerb},
+		},
+	}
+
+	roleCli := p.workload.K8sClient.RbacV1().ClusterRoles()
+	if role, err := p.crLister.Get("", roleName); err == nil {
+		if role.Labels[psptOwnerLabel] != templateName {
+			logrus.Warnf("Role [%s] already exists and wasn't created for pod security policy template [%s], leaving it alone", roleName, templateName)
+			return false, nil
+		}
+		if reflect.DeepEqual(role.Rules, rules) {
+			return true, nil
+		}
+		role = role.DeepCopy()
+		role.Rules = rules
+		if _, err := roleCli.Update(role); err != nil {
+			return false, errors.Wrapf(err, "couldn't update role %v", roleName)
+		}
+		return true, nil
+	}
+
+	_, err := roleCli.Create(&rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   roleName,
+			Labels: map[string]string{psptOwnerLabel: templateName},
+		},
+		Rules: rules,
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't create role %v", roleName)
+	}
+	return true, nil
+}
+
+func (p *pspHandler) ensurePSPBinding(ns, templateName string) error {
+	bindingName := pspBindingName(templateName)
+	if _, err := p.rbLister.Get(ns, bindingName); err == nil {
+		return nil
+	}
+
+	_, err := p.workload.K8sClient.RbacV1().RoleBindings(ns).Create(&rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   bindingName,
+			Labels: map[string]string{pspBindingLabel: templateName},
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:     rbacv1.GroupKind,
+				APIGroup: rbacv1.GroupName,
+				Name:     serviceAccountsGroup(ns),
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     pspRoleName(templateName),
+		},
+	})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "couldn't create pod security policy binding %v in %v", bindingName, ns)
+	}
+	return nil
+}
+
+// prunePSPBindings removes the bindings in the namespace that grant use of any template other than templateName.
+func (p *pspHandler) prunePSPBindings(ns, templateName string) error {
+	selector, err := labels.Parse(pspBindingLabel)
+	if err != nil {
+		return err
+	}
+
+	rbs, err := p.rbLister.List(ns, selector)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list rolebindings with selector %s", selector)
+	}
+
+	bindingCli := p.workload.K8sClient.RbacV1().RoleBindings(ns)
+	for _, rb := range rbs {
+		if rb.Labels[pspBindingLabel] == templateName {
+			continue
+		}
+		if err := bindingCli.Delete(rb.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting rolebinding %v", rb.Name)
+		}
+	}
+
+	return nil
+}
+
+func (p *pspHandler) deletePSP(templateName string) error {
+	set := labels.Set(map[string]string{psptOwnerLabel: templateName})
+
+	psps, err := p.pspLister.List("", set.AsSelector())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list pod security policies with selector %s", set.AsSelector())
+	}
+	pspCli := p.workload.K8sClient.ExtensionsV1beta1().PodSecurityPolicies()
+	for _, psp := range psps {
+		if err := pspCli.Delete(psp.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting pod security policy %v", psp.Name)
+		}
+	}
+
+	roles, err := p.crLister.List("", set.AsSelector())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list clusterroles with selector %s", set.AsSelector())
+	}
+	roleCli := p.workload.K8sClient.RbacV1().ClusterRoles()
+	for _, role := range roles {
+		if err := roleCli.Delete(role.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting clusterrole %v", role.Name)
+		}
+	}
+
+	return nil
+}
+
+func (p *pspHandler) enqueueNamespaces(selector labels.Selector) error {
+	namespaces, err := p.nsLister.List("", selector)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list namespaces with selector %s", selector)
+	}
+	for _, ns := range namespaces {
+		p.nsController.Enqueue("", ns.Name)
+	}
+	return nil
+}
+
+func pspRoleName(templateName string) string {
+	return pspRolePrefix + templateName
+}
+
+func pspBindingName(templateName string) string {
+	return pspBindingPrefix + templateName
+}
+
+func serviceAccountsGroup(ns string) string {
+	return fmt.Sprintf("system:serviceaccounts:%v", ns)
+}
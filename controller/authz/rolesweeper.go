@@ -0,0 +1,154 @@
+package authz
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/sirupsen/logrus"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	roleGCInterval = 10 * time.Minute
+)
+
+func (r *roleHandler) sweepRoles(ctx context.Context, interval time.Duration, dryRun bool) {
+	for range utils.TickerContext(ctx, interval) {
+		if err := r.deleteOrphanedRoles(dryRun); err != nil {
+			logrus.Warnf("Error removing orphaned roles %v", err)
+		}
+	}
+}
+
+// deleteOrphanedRoles deletes the ClusterRoles created by the agent for RoleTemplates when neither a RoleTemplate nor
+// a role binding references them anymore. In dry run mode the roles are only logged.
+func (r *roleHandler) deleteOrphanedRoles(dryRun bool) error {
+	set := labels.Set(map[string]string{rtManagedLabel: "true"})
+	roles, err := r.crLister.List("", set.AsSelector())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list clusterroles with selector %s", set.AsSelector())
+	}
+	if len(roles) == 0 {
+		return nil
+	}
+
+	referenced, err := r.referencedRoles()
+	if err != nil {
+		return err
+	}
+
+	roleCli := r.workload.K8sClient.RbacV1().ClusterRoles()
+	for _, role := range roles {
+		rtName := role.Annotations[rtNameAnnotation]
+		if rtName == "" {
+			rtName = role.Name
+		}
+		if referenced[role.Name] || r.roleTemplateInUse(rtName) {
+			continue
+		}
+
+		if dryRun {
+			logrus.Infof("Would delete orphaned role [%s] for role template [%s]", role.Name, rtName)
+			continue
+		}
+
+		logrus.Infof("Deleting orphaned role [%s] for role template [%s]", role.Name, rtName)
+		if err := roleCli.Delete(role.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting clusterrole %v", role.Name)
+		}
+	}
+
+	return nil
+}
+
+// roleTemplateInUse reports whether the RoleTemplate still exists or is included by another RoleTemplate.
+func (r *roleHandler) roleTemplateInUse(rtName string) bool {
+	if _, err := r.rtLister.Get("", rtName); err == nil {
+		return true
+	}
+	parents, err := r.rtIndexer.ByIndex(rtByRTIndex, rtName)
+	return err != nil || len(parents) > 0
+}
+
+// referencedRoles returns the names of the ClusterRoles referenced by any RoleBinding or ClusterRoleBinding.
+func (r *roleHandler) referencedRoles() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	rbs, err := r.rbLister.List("", labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't list rolebindings")
+	}
+	for _, rb := range rbs {
+		if rb.RoleRef.Kind == "ClusterRole" {
+			referenced[rb.RoleRef.Name] = true
+		}
+	}
+
+	crbs, err := r.crbLister.List("", labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't list clusterrolebindings")
+	}
+	for _, crb := range crbs {
+		referenced[crb.RoleRef.Name] = true
+	}
+
+	return referenced, nil
+}
+
+func setManagedRole(objectMeta *metav1.ObjectMeta, rtName string) {
+	if objectMeta.Labels == nil {
+		objectMeta.Labels = map[string]string{}
+	}
+	if objectMeta.Annotations == nil {
+		objectMeta.Annotations = map[string]string{}
+	}
+	objectMeta.Labels[rtManagedLabel] = "true"
+	objectMeta.Annotations[rtNameAnnotation] = rtName
+}
+
+// isOwnedRole reports whether the ClusterRole was created by the agent for a RoleTemplate.
+func isOwnedRole(objectMeta metav1.ObjectMeta) bool {
+	return objectMeta.Labels[rtManagedLabel] == "true"
+}
+
+// ownsRole reports whether the ClusterRole was created by the agent for a RoleTemplate. Agents from before roles were
+// labelled created them without the label; such a role is recognized by a role binding the agent created for a
+// RoleTemplate binding referring to it, and is labelled once it's updated.
+func (r *roleHandler) ownsRole(role *rbacv1.ClusterRole) (bool, error) {
+	if isOwnedRole(role.ObjectMeta) {
+		return true, nil
+	}
+
+	selector, err := labels.Parse(rtbOwnerLabel)
+	if err != nil {
+		return false, err
+	}
+	rbs, err := r.rbLister.List("", selector)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't list rolebindings with selector %s", selector)
+	}
+	for _, rb := range rbs {
+		if rb.RoleRef.Kind == "ClusterRole" && rb.RoleRef.Name == role.Name {
+			return true, nil
+		}
+	}
+	crbs, err := r.crbLister.List("", selector)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't list clusterrolebindings with selector %s", selector)
+	}
+	for _, crb := range crbs {
+		if crb.RoleRef.Name == role.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isManagedRole(objectMeta metav1.ObjectMeta, rtName string) bool {
+	return objectMeta.Labels[rtManagedLabel] == "true" && objectMeta.Annotations[rtNameAnnotation] == rtName
+}
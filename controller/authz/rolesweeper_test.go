@@ -0,0 +1,88 @@
+package authz
+
+import (
+	"gopkg.in/check.v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type RoleSweeperSuite struct{}
+
+var _ = check.Suite(&RoleSweeperSuite{})
+
+type fakeRBLister []*rbacv1.RoleBinding
+
+func (f fakeRBLister) List(namespace string, selector labels.Selector) ([]*rbacv1.RoleBinding, error) {
+	var rbs []*rbacv1.RoleBinding
+	for _, rb := range f {
+		if (namespace == "" || rb.Namespace == namespace) && selector.Matches(labels.Set(rb.Labels)) {
+			rbs = append(rbs, rb)
+		}
+	}
+	return rbs, nil
+}
+
+func (f fakeRBLister) Get(namespace, name string) (*rbacv1.RoleBinding, error) {
+	return nil, nil
+}
+
+type fakeCRBLister []*rbacv1.ClusterRoleBinding
+
+func (f fakeCRBLister) List(namespace string, selector labels.Selector) ([]*rbacv1.ClusterRoleBinding, error) {
+	var crbs []*rbacv1.ClusterRoleBinding
+	for _, crb := range f {
+		if selector.Matches(labels.Set(crb.Labels)) {
+			crbs = append(crbs, crb)
+		}
+	}
+	return crbs, nil
+}
+
+func (f fakeCRBLister) Get(namespace, name string) (*rbacv1.ClusterRoleBinding, error) {
+	return nil, nil
+}
+
+func clusterRole(name string, labels map[string]string) *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func (s *RoleSweeperSuite) TestOwnsRole(c *check.C) {
+	r := &roleHandler{
+		rbLister: fakeRBLister{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "rb1", Labels: map[string]string{rtbOwnerLabel: "uid-1"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "project-member"},
+			},
+			{
+				// not created by the agent
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "rb2"},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "admin-authored"},
+			},
+		},
+		crbLister: fakeCRBLister{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "crb1", Labels: map[string]string{rtbOwnerLabel: "uid-2"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-member"},
+			},
+		},
+	}
+
+	tests := []struct {
+		role  *rbacv1.ClusterRole
+		owned bool
+	}{
+		{role: clusterRole("labelled", map[string]string{rtManagedLabel: "true"}), owned: true},
+		// created by an agent from before roles were labelled
+		{role: clusterRole("project-member", nil), owned: true},
+		{role: clusterRole("cluster-member", nil), owned: true},
+		{role: clusterRole("admin-authored", nil), owned: false},
+		{role: clusterRole("unreferenced", nil), owned: false},
+	}
+
+	for _, test := range tests {
+		owned, err := r.ownsRole(test.role)
+		c.Assert(err, check.IsNil)
+		c.Check(owned, check.Equals, test.owned, check.Commentf("role %v", test.role.Name))
+	}
+}
@@ -0,0 +1,221 @@
+package authz
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	eventReasonBuiltinRoleMissing = "BuiltinRoleMissing"
+)
+
+// syncRoleTemplate pushes changes to a RoleTemplate's rules into the ClusterRoles of the template and of every
+// template that includes it that already exist in the cluster, roles are only created once a binding needs them. When
+// the template's RoleTemplateNames change, the bindings that reference any of those templates are enqueued so they can
+// add or prune role bindings.
+func (r *roleHandler) syncRoleTemplate(key string, rt *v3.RoleTemplate) error {
+	affected := r.includingRoleTemplates(key)
+
+	var children []string
+	if rt != nil {
+		children = rt.RoleTemplateNames
+	}
+	if r.roleTemplateChildrenChanged(key, children, rt == nil) {
+		r.enqueueBindings(affected)
+	}
+
+	if rt == nil {
+		// templates that included the deleted one now have a dangling reference
+		r.enqueueIncludingRoleTemplates(key)
+		return nil
+	}
+
+	if err := r.updateRoleTemplateConditions(rt); err != nil {
+		return err
+	}
+
+	roles := map[string]*v3.RoleTemplate{}
+	for name := range affected {
+		role, err := r.rtLister.Get("", name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return errors.Wrapf(err, "couldn't get role template %v", name)
+		}
+		roles[name] = role
+	}
+
+	return errors.Wrapf(r.updateExistingRoles(roles), "couldn't update roles for role template %v", key)
+}
+
+// updateRoleTemplateConditions records the template's Valid condition, which is false when its inheritance graph has a
+// cycle or references a missing template, and for builtin templates whether the ClusterRole they stand for exists in
+// this cluster. When validity changes, the templates including this one are validated again as well.
+func (r *roleHandler) updateRoleTemplateConditions(rt *v3.RoleTemplate) error {
+	rt = rt.DeepCopy()
+
+	validationErr := r.gatherRoles(rt, map[string]*v3.RoleTemplate{})
+	if validationErr != nil {
+		logrus.Warnf("Role template [%s] is invalid: %v", rt.Name, validationErr)
+	}
+	status, reason := conditionFromError(validationErr)
+	validityChanged := setCondition(rt, conditionRoleTemplateValid, status, reason)
+
+	availabilityChanged := false
+	var builtinErr error
+	if rt.Builtin {
+		builtinErr = r.verifyBuiltinRole(rt)
+		status, reason := conditionFromError(builtinErr)
+		availabilityChanged = setCondition(rt, roleAvailableConditionType(r.workload.ClusterName), status, reason)
+	}
+
+	if !validityChanged && !availabilityChanged {
+		return nil
+	}
+	if _, err := r.workload.Management.Management.RoleTemplates("").Update(rt); err != nil {
+		return errors.Wrapf(err, "couldn't update conditions on role template %v", rt.Name)
+	}
+
+	if validityChanged {
+		r.enqueueIncludingRoleTemplates(rt.Name)
+	}
+	if availabilityChanged && builtinErr != nil {
+		logrus.Warnf("Role template [%s] is unusable: %v", rt.Name, builtinErr)
+		r.recordEvent("ClusterRole", &metav1.ObjectMeta{Name: rt.Name}, v1.EventTypeWarning, eventReasonBuiltinRoleMissing,
+			builtinErr.Error())
+	}
+	return nil
+}
+
+// roleAvailableConditionType returns the type of the condition telling whether a builtin template can be used in the
+// cluster. Role templates are shared by all clusters, so each cluster's agent keeps a condition of its own.
+func roleAvailableConditionType(clusterName string) string {
+	return conditionRoleAvailable + "/" + clusterName
+}
+
+// verifyBuiltinRoles checks that the ClusterRoles of the builtin templates among rts exist in the cluster.
+func (r *roleHandler) verifyBuiltinRoles(rts map[string]*v3.RoleTemplate) error {
+	for _, rt := range rts {
+		if !rt.Builtin {
+			continue
+		}
+		if err := r.verifyBuiltinRole(rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBuiltinRole checks that the ClusterRole a builtin RoleTemplate refers to exists in the cluster.
+func (r *roleHandler) verifyBuiltinRole(rt *v3.RoleTemplate) error {
+	if _, err := r.crLister.Get("", rt.Name); err != nil {
+		if apierrors.IsNotFound(err) {
+			return errors.Errorf("builtin role template %v has no matching ClusterRole in this cluster", rt.Name)
+		}
+		return errors.Wrapf(err, "couldn't get role %v", rt.Name)
+	}
+	return nil
+}
+
+// enqueueBuiltinRoleTemplate re-evaluates a builtin RoleTemplate, and the bindings using it, when the ClusterRole of
+// the same name comes or goes.
+func (r *roleHandler) enqueueBuiltinRoleTemplate(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	if rt, err := r.rtLister.Get("", objMeta.GetName()); err == nil && rt.Builtin {
+		r.rtController.Enqueue("", rt.Name)
+		r.enqueueBindings(r.includingRoleTemplates(rt.Name))
+	}
+}
+
+func (r *roleHandler) enqueueIncludingRoleTemplates(name string) {
+	parents, err := r.rtIndexer.ByIndex(rtByRTIndex, name)
+	if err != nil {
+		return
+	}
+	for _, obj := range parents {
+		if parent, ok := obj.(*v3.RoleTemplate); ok {
+			r.rtController.Enqueue("", parent.Name)
+		}
+	}
+}
+
+// includingRoleTemplates returns the names of the given RoleTemplate and of every RoleTemplate that includes it,
+// directly or through other templates.
+func (r *roleHandler) includingRoleTemplates(name string) map[string]bool {
+	result := map[string]bool{name: true}
+	pending := []string{name}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+
+		parents, err := r.rtIndexer.ByIndex(rtByRTIndex, current)
+		if err != nil {
+			continue
+		}
+		for _, obj := range parents {
+			parent, ok := obj.(*v3.RoleTemplate)
+			if !ok || result[parent.Name] {
+				continue
+			}
+			result[parent.Name] = true
+			pending = append(pending, parent.Name)
+		}
+	}
+	return result
+}
+
+// roleTemplateChildrenChanged records the RoleTemplateNames last seen for the template and reports whether they
+// changed. The first observation of a template is not a change, bindings are synced on their own at startup.
+func (r *roleHandler) roleTemplateChildrenChanged(name string, children []string, deleted bool) bool {
+	r.rtChildrenLock.Lock()
+	defer r.rtChildrenLock.Unlock()
+
+	previous, seen := r.rtChildren[name]
+	if deleted {
+		delete(r.rtChildren, name)
+		return seen
+	}
+
+	r.rtChildren[name] = children
+	if !seen {
+		return false
+	}
+	if len(previous) == 0 && len(children) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(previous, children)
+}
+
+func (r *roleHandler) enqueueBindings(roleTemplateNames map[string]bool) {
+	for name := range roleTemplateNames {
+		if objs, err := r.crtbIndexer.ByIndex(crtbByRTIndex, name); err == nil {
+			for _, obj := range objs {
+				if binding, ok := obj.(*v3.ClusterRoleTemplateBinding); ok {
+					r.crtbController.Enqueue("", binding.Name)
+				}
+			}
+		}
+		if objs, err := r.prtbIndexer.ByIndex(prtbByRTIndex, name); err == nil {
+			for _, obj := range objs {
+				if binding, ok := obj.(*v3.ProjectRoleTemplateBinding); ok {
+					r.prtbController.Enqueue("", binding.Name)
+				}
+			}
+		}
+	}
+}
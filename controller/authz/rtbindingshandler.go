@@ -1,51 +1,140 @@
 package authz
 
 import (
-	"fmt"
+	"context"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/metrics"
 	"github.com/rancher/norman/types/slice"
 	typescorev1 "github.com/rancher/types/apis/core/v1"
-	typesextv1beta1 "github.com/rancher/types/apis/extensions/v1beta1"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	typesrbacv1 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
 	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	finalizerName  = "rtbFinalizer"
-	rtbOwnerLabel  = "io.cattle.rtb.owner"
-	projectIDLabel = "io.cattle.field.projectId"
+	finalizerName      = "rtbFinalizer"
+	rtbOwnerLabel      = "io.cattle.rtb.owner"
+	rtManagedLabel     = "io.cattle.rt.managed"
+	rtNameAnnotation   = "io.cattle.rt.name"
+	projectIDLabel     = "io.cattle.field.projectId"
+	prtbByProjectIndex = "authz.cluster.cattle.io/prtb-by-project"
+	prtbByRTIndex      = "authz.cluster.cattle.io/prtb-by-roletemplate"
+	crtbByRTIndex      = "authz.cluster.cattle.io/crtb-by-roletemplate"
+	rtByRTIndex        = "authz.cluster.cattle.io/rt-by-roletemplate"
+	prtbByUIDIndex     = "authz.cluster.cattle.io/prtb-by-uid"
+	crtbByUIDIndex     = "authz.cluster.cattle.io/crtb-by-uid"
 )
 
-func Register(workload *config.ClusterContext) {
+func Register(ctx context.Context, workload *config.ClusterContext, roleGCDryRun bool) {
+	prtbInformer := workload.Management.Management.ProjectRoleTemplateBindings("").Controller().Informer()
+	prtbInformer.AddIndexers(cache.Indexers{
+		prtbByProjectIndex: prtbByProject,
+		prtbByRTIndex:      prtbByRoleTemplate,
+		prtbByUIDIndex:     prtbByUID,
+	})
+	crtbInformer := workload.Management.Management.ClusterRoleTemplateBindings("").Controller().Informer()
+	crtbInformer.AddIndexers(cache.Indexers{
+		crtbByRTIndex:  crtbByRoleTemplate,
+		crtbByUIDIndex: crtbByUID,
+	})
+	rtInformer := workload.Management.Management.RoleTemplates("").Controller().Informer()
+	rtInformer.AddIndexers(cache.Indexers{
+		rtByRTIndex: rtByRoleTemplate,
+	})
+
 	r := &roleHandler{
-		workload:   workload,
-		rtLister:   workload.Management.Management.RoleTemplates("").Controller().Lister(),
-		psptLister: workload.Management.Management.PodSecurityPolicyTemplates("").Controller().Lister(),
-		nsLister:   workload.Core.Namespaces("").Controller().Lister(),
-		rbLister:   workload.RBAC.RoleBindings("").Controller().Lister(),
-		crbLister:  workload.RBAC.ClusterRoleBindings("").Controller().Lister(),
-		crLister:   workload.RBAC.ClusterRoles("").Controller().Lister(),
-		pspLister:  workload.Extensions.PodSecurityPolicies("").Controller().Lister(),
-	}
-	workload.Management.Management.ProjectRoleTemplateBindings("").Controller().AddHandler(r.syncPRTB)
-	workload.Management.Management.ClusterRoleTemplateBindings("").Controller().AddHandler(r.syncCRTB)
+		workload:        workload,
+		rtLister:        workload.Management.Management.RoleTemplates("").Controller().Lister(),
+		rtIndexer:       rtInformer.GetIndexer(),
+		prtbIndexer:     prtbInformer.GetIndexer(),
+		crtbIndexer:     crtbInformer.GetIndexer(),
+		prtbController:  workload.Management.Management.ProjectRoleTemplateBindings("").Controller(),
+		crtbController:  workload.Management.Management.ClusterRoleTemplateBindings("").Controller(),
+		rtController:    workload.Management.Management.RoleTemplates("").Controller(),
+		nsLister:        workload.Core.Namespaces("").Controller().Lister(),
+		rbLister:        workload.RBAC.RoleBindings("").Controller().Lister(),
+		crbLister:       workload.RBAC.ClusterRoleBindings("").Controller().Lister(),
+		crLister:        workload.RBAC.ClusterRoles("").Controller().Lister(),
+		rtChildren:      map[string][]string{},
+		expectedDeletes: map[string]bool{},
+	}
+	workload.Management.Management.ProjectRoleTemplateBindings("").Controller().AddHandler(func(key string, binding *v3.ProjectRoleTemplateBinding) error {
+		done := metrics.ObserveHandler("authz", "project-role-template-bindings")
+		return done(r.syncPRTB(key, binding))
+	})
+	workload.Management.Management.ClusterRoleTemplateBindings("").Controller().AddHandler(func(key string, binding *v3.ClusterRoleTemplateBinding) error {
+		done := metrics.ObserveHandler("authz", "cluster-role-template-bindings")
+		return done(r.syncCRTB(key, binding))
+	})
+	workload.Management.Management.RoleTemplates("").Controller().AddHandler(func(key string, rt *v3.RoleTemplate) error {
+		done := metrics.ObserveHandler("authz", "role-templates")
+		return done(r.syncRoleTemplate(key, rt))
+	})
+	workload.Core.Namespaces("").Controller().AddHandler(func(key string, ns *v1.Namespace) error {
+		done := metrics.ObserveHandler("authz", "namespace-bindings")
+		return done(r.syncNamespace(key, ns))
+	})
+	r.watchOwnedBindings(ctx)
+	r.reportOwnedBindings()
+	workload.RBAC.ClusterRoles("").Controller().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueueBuiltinRoleTemplate,
+		DeleteFunc: r.enqueueBuiltinRoleTemplate,
+	})
+
+	go r.sweepRoles(ctx, roleGCInterval, roleGCDryRun)
+
+	p := newPSPHandler(workload)
+	workload.Management.Management.Clusters("").Controller().AddHandler(func(key string, cluster *v3.Cluster) error {
+		done := metrics.ObserveHandler("authz", "psp-clusters")
+		return done(p.syncCluster(key, cluster))
+	})
+	workload.Management.Management.Projects("").Controller().AddHandler(func(key string, project *v3.Project) error {
+		done := metrics.ObserveHandler("authz", "psp-projects")
+		return done(p.syncProject(key, project))
+	})
+	workload.Management.Management.PodSecurityPolicyTemplates("").Controller().AddHandler(func(key string, template *v3.PodSecurityPolicyTemplate) error {
+		done := metrics.ObserveHandler("authz", "psp-templates")
+		return done(p.syncTemplate(key, template))
+	})
+	workload.Core.Namespaces("").Controller().AddHandler(func(key string, ns *v1.Namespace) error {
+		done := metrics.ObserveHandler("authz", "psp-namespaces")
+		return done(p.syncNamespace(key, ns))
+	})
 }
 
 type roleHandler struct {
-	workload   *config.ClusterContext
-	rtLister   v3.RoleTemplateLister
-	psptLister v3.PodSecurityPolicyTemplateLister
-	nsLister   typescorev1.NamespaceLister
-	crLister   typesrbacv1.ClusterRoleLister
-	crbLister  typesrbacv1.ClusterRoleBindingLister
-	rbLister   typesrbacv1.RoleBindingLister
-	pspLister  typesextv1beta1.PodSecurityPolicyLister
+	workload       *config.ClusterContext
+	rtLister       v3.RoleTemplateLister
+	rtIndexer      cache.Indexer
+	prtbIndexer    cache.Indexer
+	crtbIndexer    cache.Indexer
+	prtbController v3.ProjectRoleTemplateBindingController
+	crtbController v3.ClusterRoleTemplateBindingController
+	rtController   v3.RoleTemplateController
+	nsLister       typescorev1.NamespaceLister
+	crLister       typesrbacv1.ClusterRoleLister
+	crbLister      typesrbacv1.ClusterRoleBindingLister
+	rbLister       typesrbacv1.RoleBindingLister
+
+	// rtChildren remembers the last seen RoleTemplateNames of each RoleTemplate so that changes to the inheritance
+	// graph can be detected.
+	rtChildrenLock sync.Mutex
+	rtChildren     map[string][]string
+
+	// expectedDeletes holds the namespace/name keys of role bindings the agent is deleting itself.
+	expectedDeletesLock sync.Mutex
+	expectedDeletes     map[string]bool
 }
 
 func (r *roleHandler) syncCRTB(key string, binding *v3.ClusterRoleTemplateBinding) error {
@@ -90,18 +179,25 @@ func (r *roleHandler) ensureCRTBDelete(key string, binding *v3.ClusterRoleTempla
 func (r *roleHandler) ensureCRTB(key string, binding *v3.ClusterRoleTemplateBinding) error {
 	binding = binding.DeepCopy()
 	if r.addFinalizer(binding) {
-		if _, err := r.workload.Management.Management.ClusterRoleTemplateBindings("").Update(binding); err != nil {
+		updated, err := r.workload.Management.Management.ClusterRoleTemplateBindings("").Update(binding)
+		if err != nil {
 			return errors.Wrapf(err, "couldn't set finalizer set on %v", key)
 		}
+		binding = updated.DeepCopy()
 	}
 
-	rt, err := r.rtLister.Get("", binding.RoleTemplateName)
-	if err != nil {
-		return errors.Wrapf(err, "couldn't get role template %v", binding.RoleTemplateName)
+	roles, err := r.resolveRoles(binding.RoleTemplateName)
+	if err == nil {
+		// a binding to a builtin template whose role is missing would grant nothing
+		err = r.verifyBuiltinRoles(roles)
 	}
-
-	roles := map[string]*v3.RoleTemplate{}
-	if err := r.gatherRoles(rt, roles); err != nil {
+	status, reason := conditionFromError(err)
+	if setCondition(binding, conditionRoleTemplatesResolved, status, reason) {
+		if _, err := r.workload.Management.Management.ClusterRoleTemplateBindings("").Update(binding); err != nil {
+			return errors.Wrapf(err, "couldn't update conditions on %v", key)
+		}
+	}
+	if err != nil {
 		return err
 	}
 
@@ -109,13 +205,16 @@ func (r *roleHandler) ensureCRTB(key string, binding *v3.ClusterRoleTemplateBind
 		return errors.Wrap(err, "couldn't ensure roles")
 	}
 
+	desired := map[string]bool{}
 	for _, role := range roles {
 		if err := r.ensureClusterBinding(role.Name, binding); err != nil {
 			return errors.Wrapf(err, "couldn't ensure cluster binding %v %v", role.Name, binding.Subject.Name)
 		}
+		bindingName, _, _, _ := bindingParts(role.Name, string(binding.UID), binding.Subject)
+		desired[bindingName] = true
 	}
 
-	return nil
+	return r.pruneClusterBindings(string(binding.UID), desired)
 }
 
 func (r *roleHandler) syncPRTB(key string, binding *v3.ProjectRoleTemplateBinding) error {
@@ -134,14 +233,26 @@ func (r *roleHandler) ensurePRTB(key string, binding *v3.ProjectRoleTemplateBind
 	binding = binding.DeepCopy()
 	added := r.addFinalizer(binding)
 	if added {
-		if _, err := r.workload.Management.Management.ProjectRoleTemplateBindings("").Update(binding); err != nil {
+		updated, err := r.workload.Management.Management.ProjectRoleTemplateBindings("").Update(binding)
+		if err != nil {
 			return errors.Wrapf(err, "couldn't set finalizer set on %v", key)
 		}
+		binding = updated.DeepCopy()
 	}
 
-	rt, err := r.rtLister.Get("", binding.RoleTemplateName)
+	roles, err := r.resolveRoles(binding.RoleTemplateName)
+	if err == nil {
+		// a binding to a builtin template whose role is missing would grant nothing
+		err = r.verifyBuiltinRoles(roles)
+	}
+	status, reason := conditionFromError(err)
+	if setCondition(binding, conditionRoleTemplatesResolved, status, reason) {
+		if _, err := r.workload.Management.Management.ProjectRoleTemplateBindings("").Update(binding); err != nil {
+			return errors.Wrapf(err, "couldn't update conditions on %v", key)
+		}
+	}
 	if err != nil {
-		return errors.Wrapf(err, "couldn't get role template %v", binding.RoleTemplateName)
+		return err
 	}
 
 	// Get namespaces belonging to project
@@ -154,15 +265,17 @@ func (r *roleHandler) ensurePRTB(key string, binding *v3.ProjectRoleTemplateBind
 		return nil
 	}
 
-	roles := map[string]*v3.RoleTemplate{}
-	if err := r.gatherRoles(rt, roles); err != nil {
-		return err
-	}
-
 	if err := r.ensureRoles(roles); err != nil {
 		return errors.Wrap(err, "couldn't ensure roles")
 	}
 
+	desired := map[string]bool{}
+	for _, role := range roles {
+		bindingName, _, _, _ := bindingParts(role.Name, string(binding.UID), binding.Subject)
+		desired[bindingName] = true
+	}
+
+	set = labels.Set(map[string]string{rtbOwnerLabel: string(binding.UID)})
 	// TODO is .Items the complete list or is there potential pagination to deal with?
 	for _, ns := range namespaces {
 		for _, role := range roles {
@@ -170,6 +283,9 @@ func (r *roleHandler) ensurePRTB(key string, binding *v3.ProjectRoleTemplateBind
 				return errors.Wrapf(err, "couldn't ensure binding %v %v in %v", role.Name, binding.Subject.Name, ns.Name)
 			}
 		}
+		if err := r.pruneBindings(ns.Name, set.AsSelector(), desired); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -211,16 +327,46 @@ func (r *roleHandler) ensurePRTBDelete(key string, binding *v3.ProjectRoleTempla
 	return nil
 }
 
+// resolveRoles returns the named RoleTemplate and every RoleTemplate it includes.
+func (r *roleHandler) resolveRoles(rtName string) (map[string]*v3.RoleTemplate, error) {
+	rt, err := r.rtLister.Get("", rtName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get role template %v", rtName)
+	}
+
+	roles := map[string]*v3.RoleTemplate{}
+	if err := r.gatherRoles(rt, roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
 func (r *roleHandler) gatherRoles(rt *v3.RoleTemplate, roleTemplates map[string]*v3.RoleTemplate) error {
+	return r.gatherRolesOnPath(rt, roleTemplates, nil)
+}
+
+// gatherRolesOnPath walks the RoleTemplateNames of rt. path holds the templates currently being walked so that a
+// template including itself, directly or through others, is reported instead of recursing forever.
+func (r *roleHandler) gatherRolesOnPath(rt *v3.RoleTemplate, roleTemplates map[string]*v3.RoleTemplate, path []string) error {
+	for i, name := range path {
+		if name == rt.Name {
+			cycle := append(append([]string{}, path[i:]...), rt.Name)
+			return errors.Errorf("role template cycle detected: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if _, ok := roleTemplates[rt.Name]; ok {
+		return nil
+	}
 	roleTemplates[rt.Name] = rt
 
+	path = append(path[:len(path):len(path)], rt.Name)
 	for _, rtName := range rt.RoleTemplateNames {
 		subRT, err := r.rtLister.Get("", rtName)
 		if err != nil {
-			return errors.Wrapf(err, "couldn't get RoleTemplate %s", rtName)
+			return errors.Wrapf(err, "couldn't get RoleTemplate %s included by %s", rtName, rt.Name)
 		}
-		if err := r.gatherRoles(subRT, roleTemplates); err != nil {
-			return errors.Wrapf(err, "couldn't gather RoleTemplate %s", rtName)
+		if err := r.gatherRolesOnPath(subRT, roleTemplates, path); err != nil {
+			return err
 		}
 	}
 
@@ -263,27 +409,24 @@ func (r *roleHandler) ensureRoles(rts map[string]*v3.RoleTemplate) error {
 	roleCli := r.workload.K8sClient.RbacV1().ClusterRoles()
 	for _, rt := range rts {
 		if rt.Builtin {
-			// TODO assert the role exists and log an error if it doesnt.
 			continue
 		}
 
 		if role, err := r.crLister.Get("", rt.Name); err == nil {
-			role = role.DeepCopy()
-			// TODO potentially check a version so that we don't do unnecessary updates
-			role.Rules = rt.Rules
-			_, err := roleCli.Update(role)
-			if err != nil {
-				return errors.Wrapf(err, "couldn't update role %v", rt.Name)
+			if err := r.updateRole(role, rt); err != nil {
+				return err
 			}
+			continue
 		}
 
-		_, err := roleCli.Create(&rbacv1.ClusterRole{
+		role := &rbacv1.ClusterRole{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: rt.Name,
 			},
 			Rules: rt.Rules,
-		})
-		if err != nil {
+		}
+		setManagedRole(&role.ObjectMeta, rt.Name)
+		if _, err := roleCli.Create(role); err != nil {
 			return errors.Wrapf(err, "couldn't create role %v", rt.Name)
 		}
 	}
@@ -291,11 +434,68 @@ func (r *roleHandler) ensureRoles(rts map[string]*v3.RoleTemplate) error {
 	return nil
 }
 
+// updateExistingRoles pushes the rules of the templates into their ClusterRoles, leaving out the roles that don't exist
+// in the cluster and builtin templates.
+func (r *roleHandler) updateExistingRoles(rts map[string]*v3.RoleTemplate) error {
+	for _, rt := range rts {
+		if rt.Builtin {
+			continue
+		}
+		role, err := r.crLister.Get("", rt.Name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return errors.Wrapf(err, "couldn't get role %v", rt.Name)
+		}
+		owned, err := r.ownsRole(role)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			// reported by the bindings that need the role
+			continue
+		}
+		if err := r.updateRole(role, rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateRole sets the rules of the template on its ClusterRole and labels it as managed. A ClusterRole of the same name
+// that wasn't created by the agent is left alone and reported as a conflict.
+func (r *roleHandler) updateRole(role *rbacv1.ClusterRole, rt *v3.RoleTemplate) error {
+	if reflect.DeepEqual(role.Rules, rt.Rules) && isManagedRole(role.ObjectMeta, rt.Name) {
+		return nil
+	}
+	owned, err := r.ownsRole(role)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return errors.Errorf("clusterrole %v already exists and isn't managed by the agent", role.Name)
+	}
+	if !isOwnedRole(role.ObjectMeta) {
+		logrus.Infof("Adopting role [%s] created for role template [%s]", role.Name, rt.Name)
+	}
+	role = role.DeepCopy()
+	role.Rules = rt.Rules
+	setManagedRole(&role.ObjectMeta, rt.Name)
+	if _, err := r.workload.K8sClient.RbacV1().ClusterRoles().Update(role); err != nil {
+		return errors.Wrapf(err, "couldn't update role %v", rt.Name)
+	}
+	return nil
+}
+
 func (r *roleHandler) ensureClusterBinding(roleName string, binding *v3.ClusterRoleTemplateBinding) error {
 	bindingCli := r.workload.K8sClient.RbacV1().ClusterRoleBindings()
 	bindingName, objectMeta, subjects, roleRef := bindingParts(roleName, string(binding.UID), binding.Subject)
-	if _, err := r.crbLister.Get("", bindingName); err == nil {
-		return nil
+	if existing, err := r.crbLister.Get("", bindingName); err == nil {
+		if bindingMatches(subjects, roleRef, existing.Subjects, existing.RoleRef) {
+			return nil
+		}
+		return r.repairClusterBinding(existing, objectMeta, subjects, roleRef)
 	}
 
 	_, err := bindingCli.Create(&rbacv1.ClusterRoleBinding{
@@ -310,8 +510,11 @@ func (r *roleHandler) ensureClusterBinding(roleName string, binding *v3.ClusterR
 func (r *roleHandler) ensureBinding(ns, roleName string, binding *v3.ProjectRoleTemplateBinding) error {
 	bindingCli := r.workload.K8sClient.RbacV1().RoleBindings(ns)
 	bindingName, objectMeta, subjects, roleRef := bindingParts(roleName, string(binding.UID), binding.Subject)
-	if _, err := r.crbLister.Get("", bindingName); err == nil {
-		return nil
+	if existing, err := r.rbLister.Get(ns, bindingName); err == nil {
+		if bindingMatches(subjects, roleRef, existing.Subjects, existing.RoleRef) {
+			return nil
+		}
+		return r.repairBinding(existing, objectMeta, subjects, roleRef)
 	}
 
 	_, err := bindingCli.Create(&rbacv1.RoleBinding{
@@ -322,12 +525,64 @@ func (r *roleHandler) ensureBinding(ns, roleName string, binding *v3.ProjectRole
 	return err
 }
 
+// pruneClusterBindings deletes the ClusterRoleBindings owned by the given ClusterRoleTemplateBinding that are not in
+// the desired set. This also migrates bindings created under an older naming scheme, they are replaced by the bindings
+// ensured just before pruning.
+func (r *roleHandler) pruneClusterBindings(ownerUID string, desired map[string]bool) error {
+	set := labels.Set(map[string]string{rtbOwnerLabel: ownerUID})
+	crbs, err := r.crbLister.List("", set.AsSelector())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list clusterrolebindings with selector %s", set.AsSelector())
+	}
+
+	bindingCli := r.workload.K8sClient.RbacV1().ClusterRoleBindings()
+	for _, crb := range crbs {
+		if desired[crb.Name] {
+			continue
+		}
+		if err := r.deleteBinding("", crb.Name, bindingCli.Delete); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting clusterrolebinding %v", crb.Name)
+		}
+	}
+
+	return nil
+}
+
+// pruneBindings deletes the RoleBindings in the namespace matching the selector that are not in the desired set.
+func (r *roleHandler) pruneBindings(ns string, selector labels.Selector, desired map[string]bool) error {
+	rbs, err := r.rbLister.List(ns, selector)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list rolebindings with selector %s", selector)
+	}
+
+	bindingCli := r.workload.K8sClient.RbacV1().RoleBindings(ns)
+	for _, rb := range rbs {
+		if desired[rb.Name] {
+			continue
+		}
+		if err := r.deleteBinding(ns, rb.Name, bindingCli.Delete); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting rolebinding %v", rb.Name)
+		}
+	}
+
+	return nil
+}
+
 func bindingParts(roleName, parentUID string, subject rbacv1.Subject) (string, metav1.ObjectMeta, []rbacv1.Subject, rbacv1.RoleRef) {
-	bindingName := strings.ToLower(fmt.Sprintf("%v-%v-%v", roleName, subject.Name, parentUID))
+	subject = normalizeSubject(subject)
+	bindingName := bindingName(roleName, parentUID, subject)
+	annotations := map[string]string{
+		subjectKindAnnotation: subject.Kind,
+		subjectNameAnnotation: subject.Name,
+	}
+	if subject.Namespace != "" {
+		annotations[subjectNamespaceAnnotation] = subject.Namespace
+	}
 	return bindingName,
 		metav1.ObjectMeta{
-			Name:   bindingName,
-			Labels: map[string]string{rtbOwnerLabel: parentUID},
+			Name:        bindingName,
+			Labels:      map[string]string{rtbOwnerLabel: parentUID},
+			Annotations: annotations,
 		},
 		[]rbacv1.Subject{subject},
 		rbacv1.RoleRef{
@@ -335,3 +590,35 @@ func bindingParts(roleName, parentUID string, subject rbacv1.Subject) (string, m
 			Name: roleName,
 		}
 }
+
+func prtbByProject(obj interface{}) ([]string, error) {
+	binding, ok := obj.(*v3.ProjectRoleTemplateBinding)
+	if !ok || binding.ProjectName == "" {
+		return []string{}, nil
+	}
+	return []string{binding.ProjectName}, nil
+}
+
+func prtbByRoleTemplate(obj interface{}) ([]string, error) {
+	binding, ok := obj.(*v3.ProjectRoleTemplateBinding)
+	if !ok || binding.RoleTemplateName == "" {
+		return []string{}, nil
+	}
+	return []string{binding.RoleTemplateName}, nil
+}
+
+func crtbByRoleTemplate(obj interface{}) ([]string, error) {
+	binding, ok := obj.(*v3.ClusterRoleTemplateBinding)
+	if !ok || binding.RoleTemplateName == "" {
+		return []string{}, nil
+	}
+	return []string{binding.RoleTemplateName}, nil
+}
+
+func rtByRoleTemplate(obj interface{}) ([]string, error) {
+	rt, ok := obj.(*v3.RoleTemplate)
+	if !ok {
+		return []string{}, nil
+	}
+	return rt.RoleTemplateNames, nil
+}
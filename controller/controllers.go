@@ -6,15 +6,31 @@ import (
 	"github.com/rancher/cluster-agent/controller/authz"
 	"github.com/rancher/cluster-agent/controller/eventssyncer"
 	"github.com/rancher/cluster-agent/controller/healthsyncer"
+	"github.com/rancher/cluster-agent/controller/heartbeat"
 	"github.com/rancher/cluster-agent/controller/nodesyncer"
 	"github.com/rancher/cluster-agent/controller/statsyncer"
 	"github.com/rancher/types/config"
 )
 
-func Register(ctx context.Context, cluster *config.ClusterContext) {
-	nodesyncer.Register(cluster)
+// Options holds the settings for the controllers that can be changed from the command line.
+type Options struct {
+	// RoleGCDryRun makes the authz controllers only log the orphaned ClusterRoles they would delete.
+	RoleGCDryRun bool
+	// NodeSync selects what is synced between nodes and Machines.
+	NodeSync nodesyncer.Options
+	// EventSync selects the events synced to the management plane and how long they are kept.
+	EventSync eventssyncer.Options
+	// Version of the agent, reported to the cluster manager with the heartbeat.
+	Version string
+}
+
+func Register(ctx context.Context, cluster *config.ClusterContext, opts Options) {
+	nodesyncer.Register(ctx, cluster, opts.NodeSync)
 	healthsyncer.Register(ctx, cluster)
-	authz.Register(cluster)
+	authz.Register(ctx, cluster, opts.RoleGCDryRun)
 	statsyncer.Register(ctx, cluster)
-	eventssyncer.Register(cluster)
+	eventssyncer.Register(ctx, cluster, opts.EventSync)
+	heartbeat.Register(ctx, cluster, opts.Version, []string{
+		"nodesyncer", "healthsyncer", "authz", "statsyncer", "eventssyncer", "heartbeat",
+	})
 }
@@ -0,0 +1,108 @@
+package eventssyncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	clusterv1 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	eventNameHashLength = 16
+	// eventSourcesAnnotation holds the count of every event aggregated into a ClusterEvent, keyed by the event's
+	// namespace and name, so the ClusterEvent's count can be kept as the sum when one of them changes.
+	eventSourcesAnnotation = "io.cattle.event.sources"
+	// maxEventSources caps the events tracked per ClusterEvent, the counts of events beyond that are still added to
+	// the ClusterEvent's count but can't be corrected anymore when those events change.
+	maxEventSources = 100
+)
+
+// clusterEventName returns the name of the ClusterEvent an event is aggregated into. Events about the same object with
+// the same reason and message are aggregated, and names are prefixed with the cluster name so they're unique across
+// clusters.
+func clusterEventName(clusterName string, event *v1.Event) string {
+	involved := event.InvolvedObject
+	key := strings.Join([]string{involved.Kind, involved.Namespace, involved.Name, string(involved.UID), event.Reason,
+		event.Message}, "\x00")
+	hash := sha256.Sum256([]byte(key))
+	return clusterName + "-" + hex.EncodeToString(hash[:])[:eventNameHashLength]
+}
+
+func eventSourceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// aggregateInto folds the event into the existing ClusterEvent of the given name.
+func (e *EventsSyncer) aggregateInto(name, sourceKey string, event *v1.Event) error {
+	existing, err := e.ClusterEvents.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing = existing.DeepCopy()
+	if !aggregateEvent(existing, sourceKey, event) {
+		return nil
+	}
+	_, err = e.ClusterEvents.Update(existing)
+	return err
+}
+
+// eventSources returns the counts of the events aggregated into the ClusterEvent, keyed by eventSourceKey.
+func eventSources(clusterEvent *clusterv1.ClusterEvent) map[string]int32 {
+	sources := map[string]int32{}
+	if value := clusterEvent.Annotations[eventSourcesAnnotation]; value != "" {
+		// a malformed annotation is simply overwritten
+		json.Unmarshal([]byte(value), &sources)
+	}
+	return sources
+}
+
+// aggregateEvent folds the event into the ClusterEvent and reports whether the ClusterEvent changed. The count is the
+// sum of the counts of the aggregated events, the timestamps span all of them.
+func aggregateEvent(clusterEvent *clusterv1.ClusterEvent, sourceKey string, event *v1.Event) bool {
+	sources := eventSources(clusterEvent)
+	count := eventCount(event)
+	previous, tracked := sources[sourceKey]
+	if tracked && previous == count && !event.LastTimestamp.After(clusterEvent.LastTimestamp.Time) {
+		return false
+	}
+
+	switch {
+	case tracked:
+		clusterEvent.Count += count - previous
+		sources[sourceKey] = count
+	case len(sources) < maxEventSources:
+		clusterEvent.Count += count
+		sources[sourceKey] = count
+	default:
+		clusterEvent.Count += count
+	}
+
+	if !event.FirstTimestamp.IsZero() && (clusterEvent.FirstTimestamp.IsZero() || event.FirstTimestamp.Before(&clusterEvent.FirstTimestamp)) {
+		clusterEvent.FirstTimestamp = event.FirstTimestamp
+	}
+	if event.LastTimestamp.After(clusterEvent.LastTimestamp.Time) {
+		clusterEvent.LastTimestamp = event.LastTimestamp
+		clusterEvent.Source = event.Source
+		clusterEvent.Type = event.Type
+	}
+
+	value, err := json.Marshal(sources)
+	if err == nil {
+		if clusterEvent.Annotations == nil {
+			clusterEvent.Annotations = map[string]string{}
+		}
+		clusterEvent.Annotations[eventSourcesAnnotation] = string(value)
+	}
+	return true
+}
+
+func eventCount(event *v1.Event) int32 {
+	if event.Count < 1 {
+		return 1
+	}
+	return event.Count
+}
@@ -1,62 +1,98 @@
 package eventssyncer
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	"github.com/rancher/cluster-agent/metrics"
+	"github.com/rancher/cluster-agent/utils"
+	corev1 "github.com/rancher/types/apis/core/v1"
 	clusterv1 "github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
+const (
+	// throttleRetryDelay is how long an event that hit the creation rate limit waits before it's synced again
+	throttleRetryDelay = time.Minute
+)
+
+var throttledEvents = metrics.NewCounterVec("events_throttled_total", "Number of events delayed by the cluster event creation rate limit.")
+
 type EventsSyncer struct {
-	clusterName   string
-	Clusters      clusterv1.ClusterInterface
-	ClusterEvents clusterv1.ClusterEventInterface
+	clusterName     string
+	Clusters        clusterv1.ClusterInterface
+	ClusterEvents   clusterv1.ClusterEventInterface
+	eventLister     corev1.EventLister
+	eventController corev1.EventController
+	opts            Options
+	createLimiter   flowcontrol.RateLimiter
 }
 
-func Register(workload *config.ClusterContext) {
+func Register(ctx context.Context, workload *config.ClusterContext, opts Options) {
 	e := &EventsSyncer{
-		clusterName:   workload.ClusterName,
-		Clusters:      workload.Management.Management.Clusters(""),
-		ClusterEvents: workload.Management.Management.ClusterEvents(""),
+		clusterName:     workload.ClusterName,
+		Clusters:        workload.Management.Management.Clusters(""),
+		ClusterEvents:   workload.Management.Management.ClusterEvents(""),
+		eventLister:     workload.Core.Events("").Controller().Lister(),
+		eventController: workload.Core.Events("").Controller(),
+		opts:            opts,
 	}
-	workload.Core.Events("").Controller().AddHandler(e.sync)
+	if opts.CreatesPerMinute > 0 {
+		e.createLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(opts.CreatesPerMinute)/60, opts.CreatesPerMinute)
+	}
+	workload.Core.Events("").Controller().AddHandler(func(key string, event *v1.Event) error {
+		done := metrics.ObserveHandler("eventssyncer", "events")
+		return done(e.sync(key, event))
+	})
+
+	go utils.RetryContext(ctx, migrationRetryInterval, "Migrating cluster events", e.migrateClusterEvents)
+	go e.reapEvents(ctx, reapInterval)
 }
 
 func (e *EventsSyncer) sync(key string, event *v1.Event) error {
-	if event == nil {
+	// expired events would be recreated right after the reaper deleted them
+	if event == nil || !e.opts.allowed(event) || e.expired(event) {
 		return nil
 	}
 	return e.createClusterEvent(key, event)
 }
 
+// createClusterEvent creates the ClusterEvent the event is aggregated into, or folds the event into the existing one.
 func (e *EventsSyncer) createClusterEvent(key string, event *v1.Event) error {
-	existing, err := e.ClusterEvents.Get(event.Name, metav1.GetOptions{})
-
-	if err == nil || apierrors.IsNotFound(err) {
-		if existing != nil && existing.Name != "" {
-			return nil
-		}
-		cluster, err := e.Clusters.Get(e.clusterName, metav1.GetOptions{})
-		if err != nil {
-			if apierrors.IsNotFound(err) {
-				return nil
-			}
-			return fmt.Errorf("Failed to get cluster [%s] %v", e.clusterName, err)
-		}
+	name := clusterEventName(e.clusterName, event)
+	err := e.aggregateInto(name, eventSourceKey(event.Namespace, event.Name), event)
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
 
-		if cluster.DeletionTimestamp != nil {
+	cluster, err := e.Clusters.Get(e.clusterName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
 			return nil
 		}
-		logrus.Infof("Creating cluster event [%s]", event.Message)
-		clusterEvent := e.convertEventToClusterEvent(event, cluster)
-		_, err = e.ClusterEvents.Create(clusterEvent)
-		return err
+		return fmt.Errorf("Failed to get cluster [%s] %v", e.clusterName, err)
 	}
 
+	if cluster.DeletionTimestamp != nil {
+		return nil
+	}
+	if e.createLimiter != nil && !e.createLimiter.TryAccept() {
+		logrus.Debugf("Delaying event [%s/%s], cluster event creation rate exceeded", event.Namespace, event.Name)
+		throttledEvents.With().Inc()
+		time.AfterFunc(throttleRetryDelay, func() {
+			e.eventController.Enqueue(event.Namespace, event.Name)
+		})
+		return nil
+	}
+	logrus.Infof("Creating cluster event [%s]", event.Message)
+	clusterEvent := e.convertEventToClusterEvent(event, cluster)
+	_, err = e.ClusterEvents.Create(clusterEvent)
 	return err
 }
 
@@ -68,10 +104,15 @@ func (e *EventsSyncer) convertEventToClusterEvent(event *v1.Event, cluster *clus
 	clusterEvent.Kind = "ClusterEvent"
 	clusterEvent.ClusterName = e.clusterName
 	clusterEvent.ObjectMeta = metav1.ObjectMeta{
-		Name:        event.Name,
-		Labels:      event.Labels,
-		Annotations: event.Annotations,
+		Name:        clusterEventName(e.clusterName, event),
+		Labels:      clusterEventLabels(event.Labels, e.clusterName),
+		Annotations: map[string]string{},
+	}
+	for key, value := range event.Annotations {
+		clusterEvent.Annotations[key] = value
 	}
+	clusterEvent.Count = 0
+	aggregateEvent(clusterEvent, eventSourceKey(event.Namespace, event.Name), event)
 	ref := metav1.OwnerReference{
 		Name:       e.clusterName,
 		UID:        cluster.UID,
@@ -81,3 +122,12 @@ func (e *EventsSyncer) convertEventToClusterEvent(event *v1.Event, cluster *clus
 	clusterEvent.ObjectMeta.OwnerReferences = append(clusterEvent.ObjectMeta.OwnerReferences, ref)
 	return clusterEvent
 }
+
+func clusterEventLabels(eventLabels map[string]string, clusterName string) map[string]string {
+	labels := map[string]string{}
+	for key, value := range eventLabels {
+		labels[key] = value
+	}
+	labels[utils.ClusterNameLabel] = clusterName
+	return labels
+}
@@ -0,0 +1,52 @@
+package eventssyncer
+
+import (
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// Options holds the settings of the events syncer.
+type Options struct {
+	// Types, Namespaces, Reasons and Kinds select the events synced by their type, namespace, reason and the kind of
+	// their involved object.
+	Types      Filter
+	Namespaces Filter
+	Reasons    Filter
+	Kinds      Filter
+	// CreatesPerMinute caps the ClusterEvents created per minute, events over the cap are synced again later. 0
+	// disables the cap.
+	CreatesPerMinute int
+	// TTL is how long ClusterEvents are kept after they last occurred. 0 keeps them forever.
+	TTL time.Duration
+	// MaxEvents is the number of ClusterEvents kept for the cluster, the oldest ones over it are deleted, those whose
+	// events are gone from the cluster first. 0 disables the limit.
+	MaxEvents int
+}
+
+// Filter selects values. A value is allowed if it's not in Exclude and, when Include is not empty, it's in Include.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f Filter) Allowed(value string) bool {
+	if contains(f.Exclude, value) {
+		return false
+	}
+	return len(f.Include) == 0 || contains(f.Include, value)
+}
+
+func (o Options) allowed(event *v1.Event) bool {
+	return o.Types.Allowed(event.Type) && o.Namespaces.Allowed(event.Namespace) && o.Reasons.Allowed(event.Reason) &&
+		o.Kinds.Allowed(event.InvolvedObject.Kind)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package eventssyncer
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/utils"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	migrationRetryInterval = 30 * time.Second
+)
+
+// migrateClusterEvents moves the ClusterEvents of this cluster that were created before they were labeled with their
+// cluster into the ClusterEvents they are aggregated into now. Those ClusterEvents were named after the event but don't
+// have its namespace, it's derived from the involved object the way the event recorder picks it.
+func (e *EventsSyncer) migrateClusterEvents() error {
+	clusterEvents, err := e.ClusterEvents.List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "couldn't list cluster events")
+	}
+
+	for _, clusterEvent := range clusterEvents.Items {
+		if clusterEvent.ClusterName != e.clusterName || clusterEvent.Labels[utils.ClusterNameLabel] == e.clusterName {
+			continue
+		}
+
+		sourceKey := eventSourceKey(recordedNamespace(clusterEvent.InvolvedObject), clusterEvent.Name)
+		migrated := clusterEvent.DeepCopy()
+		migrated.ObjectMeta = metav1.ObjectMeta{
+			Name:            clusterEventName(e.clusterName, &clusterEvent.Event),
+			Labels:          clusterEventLabels(clusterEvent.Labels, e.clusterName),
+			Annotations:     clusterEvent.Annotations,
+			OwnerReferences: clusterEvent.OwnerReferences,
+		}
+		migrated.Count = 0
+		aggregateEvent(migrated, sourceKey, &clusterEvent.Event)
+
+		_, err := e.ClusterEvents.Create(migrated)
+		if apierrors.IsAlreadyExists(err) {
+			err = e.aggregateInto(migrated.Name, sourceKey, &clusterEvent.Event)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't migrate cluster event %v", clusterEvent.Name)
+		}
+		if err := e.ClusterEvents.Delete(clusterEvent.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "couldn't delete cluster event %v", clusterEvent.Name)
+		}
+	}
+	return nil
+}
+
+// recordedNamespace returns the namespace an event about the object is recorded in, events about cluster scoped objects
+// go to the default namespace.
+func recordedNamespace(ref v1.ObjectReference) string {
+	if ref.Namespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return ref.Namespace
+}
@@ -0,0 +1,121 @@
+package eventssyncer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/metrics"
+	"github.com/rancher/cluster-agent/utils"
+	clusterv1 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	reapInterval = 10 * time.Minute
+)
+
+func (e *EventsSyncer) reapEvents(ctx context.Context, interval time.Duration) {
+	for range utils.TickerContext(ctx, interval) {
+		if err := e.deleteExpiredEvents(); err != nil {
+			logrus.Warnf("Error removing expired cluster events %v", err)
+		}
+	}
+}
+
+// deleteExpiredEvents deletes the ClusterEvents of this cluster that last occurred longer than the TTL ago, and then
+// the oldest ones over the count limit. Over the limit, ClusterEvents whose events are gone from the cluster go first,
+// since the others come back when their event occurs again; when that isn't enough the oldest of the others go as well,
+// so the limit always holds. The number of ClusterEvents kept is reported on /metrics.
+func (e *EventsSyncer) deleteExpiredEvents() error {
+	set := labels.Set(map[string]string{utils.ClusterNameLabel: e.clusterName})
+	clusterEvents, err := e.ClusterEvents.List(metav1.ListOptions{LabelSelector: set.String()})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list cluster events with selector %s", set)
+	}
+
+	events := clusterEvents.Items
+	sort.Slice(events, func(i, j int) bool {
+		return lastOccurred(&events[i].Event).After(lastOccurred(&events[j].Event))
+	})
+
+	expiry := time.Now().Add(-e.opts.TTL)
+	var expired []string
+	var remaining []*clusterv1.ClusterEvent
+	for i := range events {
+		if e.opts.TTL > 0 && lastOccurred(&events[i].Event).Before(expiry) {
+			expired = append(expired, events[i].Name)
+			continue
+		}
+		remaining = append(remaining, &events[i])
+	}
+	expired = append(expired, e.overLimit(remaining)...)
+	metrics.ManagedObjects.With("ClusterEvent").Set(float64(len(events) - len(expired)))
+	if len(expired) == 0 {
+		return nil
+	}
+
+	logrus.Infof("Deleting [%d] expired cluster events of cluster [%s]", len(expired), e.clusterName)
+	for _, name := range expired {
+		if err := e.ClusterEvents.Delete(name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "couldn't delete cluster event %v", name)
+		}
+	}
+	return nil
+}
+
+// overLimit returns the names of the ClusterEvents to delete to bring them down to the count limit. The events are
+// sorted newest first; the oldest ones whose events are gone are picked first, then the oldest of the rest.
+func (e *EventsSyncer) overLimit(events []*clusterv1.ClusterEvent) []string {
+	excess := len(events) - e.opts.MaxEvents
+	if e.opts.MaxEvents <= 0 || excess <= 0 {
+		return nil
+	}
+
+	var names []string
+	picked := map[string]bool{}
+	for i := len(events) - 1; i >= 0 && len(names) < excess; i-- {
+		if !e.sourcesExist(events[i]) {
+			names = append(names, events[i].Name)
+			picked[events[i].Name] = true
+		}
+	}
+	for i := len(events) - 1; i >= 0 && len(names) < excess; i-- {
+		if !picked[events[i].Name] {
+			names = append(names, events[i].Name)
+		}
+	}
+	return names
+}
+
+// sourcesExist reports whether any of the events aggregated into the ClusterEvent is still in the cluster.
+func (e *EventsSyncer) sourcesExist(clusterEvent *clusterv1.ClusterEvent) bool {
+	for key := range eventSources(clusterEvent) {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := e.eventLister.Get(parts[0], parts[1]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether the event last occurred longer than the TTL ago.
+func (e *EventsSyncer) expired(event *v1.Event) bool {
+	return e.opts.TTL > 0 && lastOccurred(event).Before(time.Now().Add(-e.opts.TTL))
+}
+
+func lastOccurred(event *v1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	return event.CreationTimestamp.Time
+}
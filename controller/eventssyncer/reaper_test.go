@@ -0,0 +1,73 @@
+package eventssyncer
+
+import (
+	"testing"
+
+	clusterv1 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type ReaperSuite struct{}
+
+var _ = check.Suite(&ReaperSuite{})
+
+// fakeEventLister serves the events whose namespace/name keys it holds.
+type fakeEventLister map[string]bool
+
+func (f fakeEventLister) List(namespace string, selector labels.Selector) ([]*v1.Event, error) {
+	return nil, nil
+}
+
+func (f fakeEventLister) Get(namespace, name string) (*v1.Event, error) {
+	if f[eventSourceKey(namespace, name)] {
+		return &v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "events"}, name)
+}
+
+func clusterEvent(name, source string) *clusterv1.ClusterEvent {
+	return &clusterv1.ClusterEvent{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Annotations: map[string]string{eventSourcesAnnotation: `{"` + source + `":1}`},
+	}}
+}
+
+func (s *ReaperSuite) TestOverLimitPrefersEventsThatAreGone(c *check.C) {
+	e := &EventsSyncer{
+		eventLister: fakeEventLister{"default/live1": true, "default/live2": true, "default/live3": true},
+		opts:        Options{MaxEvents: 2},
+	}
+	// newest first
+	events := []*clusterv1.ClusterEvent{
+		clusterEvent("newest", "default/live1"),
+		clusterEvent("gone", "default/gone"),
+		clusterEvent("older", "default/live2"),
+		clusterEvent("oldest", "default/live3"),
+	}
+
+	c.Assert(e.overLimit(events), check.DeepEquals, []string{"gone", "oldest"})
+}
+
+func (s *ReaperSuite) TestOverLimitBoundsLiveEvents(c *check.C) {
+	e := &EventsSyncer{
+		eventLister: fakeEventLister{"default/a": true, "default/b": true, "default/c": true},
+		opts:        Options{MaxEvents: 1},
+	}
+	events := []*clusterv1.ClusterEvent{
+		clusterEvent("a", "default/a"),
+		clusterEvent("b", "default/b"),
+		clusterEvent("c", "default/c"),
+	}
+
+	c.Assert(e.overLimit(events), check.DeepEquals, []string{"c", "b"})
+
+	e.opts.MaxEvents = 0
+	c.Assert(e.overLimit(events), check.HasLen, 0)
+}
@@ -2,36 +2,48 @@ package healthsyncer
 
 import (
 	"fmt"
+	"reflect"
 	"time"
 
 	"context"
 
+	"github.com/rancher/cluster-agent/metrics"
 	"github.com/rancher/cluster-agent/utils"
 	corev1 "github.com/rancher/types/apis/core/v1"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
 	syncInterval = 15 * time.Second
 	msgReady     = "Cluster ready to serve API"
-	msgNotReady  = "Cluster not ready to serve API"
 )
 
 type HealthSyncer struct {
 	clusterName       string
 	Clusters          v3.ClusterInterface
+	restClient        rest.Interface
 	ComponentStatuses corev1.ComponentStatusInterface
+	clusterLister     v3.ClusterLister
+	nodeLister        corev1.NodeLister
+	k8sClient         kubernetes.Interface
 }
 
 func Register(ctx context.Context, workload *config.ClusterContext) {
 	h := &HealthSyncer{
 		clusterName:       workload.ClusterName,
 		Clusters:          workload.Management.Management.Clusters(""),
+		restClient:        workload.Management.Management.RESTClient(),
 		ComponentStatuses: workload.Core.ComponentStatuses(""),
+		clusterLister:     workload.Management.Management.Clusters("").Controller().Lister(),
+		nodeLister:        workload.Core.Nodes("").Controller().Lister(),
+		k8sClient:         workload.K8sClient,
 	}
 
 	go h.syncHealth(ctx, syncInterval)
@@ -39,7 +51,8 @@ func Register(ctx context.Context, workload *config.ClusterContext) {
 
 func (h *HealthSyncer) syncHealth(ctx context.Context, syncHealth time.Duration) {
 	for range utils.TickerContext(ctx, syncHealth) {
-		err := h.updateClusterHealth()
+		done := metrics.ObserveSync("healthsyncer")
+		err := done(h.updateClusterHealth())
 		if err != nil {
 			logrus.Info(err)
 		}
@@ -52,40 +65,79 @@ func (h *HealthSyncer) updateClusterHealth() error {
 		return err
 	}
 	if cluster == nil {
-		logrus.Info("Skip updating cluster health, cluster [%s] deleted", h.clusterName)
+		logrus.Infof("Skip updating cluster health, cluster [%s] deleted", h.clusterName)
 		return nil
 	}
 	if !utils.IsClusterProvisioned(cluster) {
 		return fmt.Errorf("Skip updating cluster health - cluster [%s] not provisioned yet", h.clusterName)
 	}
-	cses, err := h.ComponentStatuses.List(metav1.ListOptions{})
-	if err != nil {
-		logrus.Debugf("Error getting componentstatuses for server health %v", err)
-		updateConditionStatus(cluster, v3.ClusterConditionReady, v1.ConditionFalse, msgNotReady)
-		return nil
-	}
-	updateConditionStatus(cluster, v3.ClusterConditionReady, v1.ConditionTrue, msgReady)
-	logrus.Infof("Cluster [%s] Condition Ready", h.clusterName)
 
-	h.updateClusterStatus(cluster, cses.Items)
-	_, err = h.Clusters.Update(cluster)
+	var cses []v1.ComponentStatus
+	probes := []probe{
+		{reason: reasonAPIServerUnhealthy, check: h.probeAPIServer},
+		{reason: reasonComponentUnhealthy, check: func() error {
+			list, err := h.ComponentStatuses.List(metav1.ListOptions{})
+			if err != nil {
+				return fmt.Errorf("Error getting component statuses %v", err)
+			}
+			cses = list.Items
+			return probeComponents(cses)
+		}},
+		{reason: reasonNodesNotReady, check: h.probeNodes},
+	}
+	for _, workload := range criticalWorkloads {
+		workload := workload
+		probes = append(probes, probe{reason: workload.reason, check: func() error {
+			return h.probeWorkload(workload)
+		}})
+	}
+	reason, message := runProbes(probes)
+
+	changed := false
+	err = utils.UpdateCluster(h.restClient, h.Clusters, cluster, func(cluster *v3.Cluster) bool {
+		changed = false
+		if reason != "" {
+			changed = utils.SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionFalse, reason, message)
+		} else {
+			changed = utils.SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, msgReady, "")
+		}
+		if cses != nil && h.updateClusterStatus(cluster, cses) {
+			changed = true
+		}
+		return changed
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to update cluster [%s] %v", cluster.Name, err)
+		return fmt.Errorf("Failed to update cluster [%s] %v", h.clusterName, err)
+	}
+	if changed {
+		logrus.Infof("Updated cluster health successfully [%s]", h.clusterName)
+	}
+	if reason != "" {
+		logrus.Debugf("Cluster [%s] is not ready: %s", h.clusterName, message)
 	}
-	logrus.Infof("Updated cluster health successfully [%s]", h.clusterName)
 	return nil
 }
 
-func (h *HealthSyncer) updateClusterStatus(cluster *v3.Cluster, cses []v1.ComponentStatus) {
-	cluster.Status.ComponentStatuses = []v3.ClusterComponentStatus{}
+// updateClusterStatus sets the component statuses of the cluster and reports whether they changed.
+func (h *HealthSyncer) updateClusterStatus(cluster *v3.Cluster, cses []v1.ComponentStatus) bool {
+	componentStatuses := []v3.ClusterComponentStatus{}
 	for _, cs := range cses {
 		clusterCS := convertToClusterComponentStatus(&cs)
-		cluster.Status.ComponentStatuses = append(cluster.Status.ComponentStatuses, *clusterCS)
+		componentStatuses = append(componentStatuses, *clusterCS)
+	}
+	if reflect.DeepEqual(cluster.Status.ComponentStatuses, componentStatuses) {
+		return false
 	}
+	cluster.Status.ComponentStatuses = componentStatuses
+	return true
 }
 
 func (h *HealthSyncer) getCluster() (*v3.Cluster, error) {
-	return h.Clusters.Get(h.clusterName, metav1.GetOptions{})
+	cluster, err := h.clusterLister.Get("", h.clusterName)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return cluster, err
 }
 
 func convertToClusterComponentStatus(cs *v1.ComponentStatus) *v3.ClusterComponentStatus {
@@ -94,27 +146,3 @@ func convertToClusterComponentStatus(cs *v1.ComponentStatus) *v3.ClusterComponen
 		Conditions: cs.Conditions,
 	}
 }
-
-func updateConditionStatus(cluster *v3.Cluster, conditionType v3.ClusterConditionType, status v1.ConditionStatus, msg string) {
-	pos, condition := getConditionByType(cluster, conditionType)
-	currTime := time.Now().UTC().Format(time.RFC3339)
-
-	if condition != nil {
-		if condition.Status != status {
-			condition.Status = status
-			condition.LastTransitionTime = currTime
-		}
-		condition.LastUpdateTime = currTime
-		condition.Reason = msg
-		cluster.Status.Conditions[pos] = *condition
-	}
-}
-
-func getConditionByType(cluster *v3.Cluster, conditionType v3.ClusterConditionType) (int, *v3.ClusterCondition) {
-	for index, condition := range cluster.Status.Conditions {
-		if condition.Type == conditionType {
-			return index, &condition
-		}
-	}
-	return -1, nil
-}
@@ -0,0 +1,144 @@
+package healthsyncer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// minReadyNodesRatio is the share of nodes that has to be Ready for the cluster to be healthy.
+	minReadyNodesRatio = 0.5
+
+	// Reasons of the Ready condition, one for each probe.
+	reasonAPIServerUnhealthy = "APIServerUnhealthy"
+	reasonComponentUnhealthy = "ComponentUnhealthy"
+	reasonNodesNotReady      = "NodesNotReady"
+	reasonDNSUnavailable     = "DNSUnavailable"
+)
+
+// criticalWorkload is a kube-system workload the cluster can't serve without.
+type criticalWorkload struct {
+	name     string
+	reason   string
+	selector labels.Set
+}
+
+var criticalWorkloads = []criticalWorkload{
+	{
+		name:     "DNS",
+		reason:   reasonDNSUnavailable,
+		selector: labels.Set{"k8s-app": "kube-dns"},
+	},
+}
+
+// probe checks one aspect of the cluster's health. check returns why it's unhealthy, or nil, and reason is the reason
+// of the Ready condition when it fails.
+type probe struct {
+	reason string
+	check  func() error
+}
+
+// runProbes runs every probe and returns the reason of the first one that failed along with the errors of all of them
+// joined into a message. The reason is empty when every probe passed.
+func runProbes(probes []probe) (string, string) {
+	reason := ""
+	var failures []string
+	for _, probe := range probes {
+		err := probe.check()
+		if err == nil {
+			continue
+		}
+		if reason == "" {
+			reason = probe.reason
+		}
+		failures = append(failures, err.Error())
+	}
+	return reason, strings.Join(failures, "; ")
+}
+
+// probeAPIServer checks the apiserver's health endpoint.
+func (h *HealthSyncer) probeAPIServer() error {
+	body, err := h.k8sClient.Discovery().RESTClient().Get().AbsPath("/healthz").Do().Raw()
+	if err != nil {
+		return errors.Wrap(err, "API server health check failed")
+	}
+	if string(body) != "ok" {
+		return errors.Errorf("API server is unhealthy: %s", body)
+	}
+	return nil
+}
+
+// probeComponents checks the Healthy condition of every component status.
+func probeComponents(cses []v1.ComponentStatus) error {
+	var unhealthy []string
+	for _, cs := range cses {
+		healthy := false
+		message := ""
+		for _, condition := range cs.Conditions {
+			if condition.Type == v1.ComponentHealthy {
+				healthy = condition.Status == v1.ConditionTrue
+				message = condition.Error
+				if message == "" {
+					message = condition.Message
+				}
+			}
+		}
+		if !healthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", cs.Name, message))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return errors.Errorf("Unhealthy components: %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
+}
+
+// probeNodes checks that enough of the nodes are Ready.
+func (h *HealthSyncer) probeNodes() error {
+	nodes, err := h.nodeLister.List("", labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "couldn't list nodes")
+	}
+	if len(nodes) == 0 {
+		return errors.New("Cluster has no nodes")
+	}
+
+	ready := 0
+	for _, node := range nodes {
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+				ready++
+			}
+		}
+	}
+	if float64(ready)/float64(len(nodes)) < minReadyNodesRatio {
+		return errors.Errorf("Only %d of %d nodes are ready", ready, len(nodes))
+	}
+	return nil
+}
+
+// probeWorkload checks that the critical workload has an available replica.
+func (h *HealthSyncer) probeWorkload(workload criticalWorkload) error {
+	deployments, err := h.k8sClient.ExtensionsV1beta1().Deployments(metav1.NamespaceSystem).List(metav1.ListOptions{
+		LabelSelector: workload.selector.String(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get %s deployments", workload.name)
+	}
+	if len(deployments.Items) == 0 {
+		return errors.Errorf("%s is not deployed", workload.name)
+	}
+	available := int32(0)
+	for _, deployment := range deployments.Items {
+		available += deployment.Status.AvailableReplicas
+	}
+	if available == 0 {
+		return errors.Errorf("%s has no available replicas", workload.name)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package healthsyncer
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type ProbesSuite struct{}
+
+var _ = check.Suite(&ProbesSuite{})
+
+func passing() error { return nil }
+
+func failing(msg string) func() error {
+	return func() error { return errors.New(msg) }
+}
+
+func (s *ProbesSuite) TestRunProbesReportsEachProbesReason(c *check.C) {
+	tests := []struct {
+		probes  []probe
+		reason  string
+		message string
+	}{
+		{
+			probes: []probe{
+				{reason: reasonAPIServerUnhealthy, check: passing},
+				{reason: reasonComponentUnhealthy, check: passing},
+			},
+		},
+		{
+			probes: []probe{
+				{reason: reasonAPIServerUnhealthy, check: passing},
+				{reason: reasonNodesNotReady, check: failing("Only 1 of 3 nodes are ready")},
+			},
+			reason:  reasonNodesNotReady,
+			message: "Only 1 of 3 nodes are ready",
+		},
+		{
+			// the first failing probe gives the reason, the message lists every failure
+			probes: []probe{
+				{reason: reasonComponentUnhealthy, check: failing("Unhealthy components: etcd-0 (timeout)")},
+				{reason: reasonNodesNotReady, check: passing},
+				{reason: reasonDNSUnavailable, check: failing("DNS has no available replicas")},
+			},
+			reason:  reasonComponentUnhealthy,
+			message: "Unhealthy components: etcd-0 (timeout); DNS has no available replicas",
+		},
+	}
+
+	for _, test := range tests {
+		reason, message := runProbes(test.probes)
+		c.Check(reason, check.Equals, test.reason)
+		c.Check(message, check.Equals, test.message)
+	}
+}
+
+func (s *ProbesSuite) TestProbeComponents(c *check.C) {
+	component := func(name string, status v1.ConditionStatus, errMsg string) v1.ComponentStatus {
+		return v1.ComponentStatus{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Conditions: []v1.ComponentCondition{{Type: v1.ComponentHealthy, Status: status, Error: errMsg}},
+		}
+	}
+
+	c.Assert(probeComponents([]v1.ComponentStatus{
+		component("scheduler", v1.ConditionTrue, ""),
+		component("etcd-0", v1.ConditionTrue, ""),
+	}), check.IsNil)
+
+	err := probeComponents([]v1.ComponentStatus{
+		component("scheduler", v1.ConditionTrue, ""),
+		component("etcd-0", v1.ConditionFalse, "connection refused"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "controller-manager"}},
+	})
+	c.Assert(err, check.ErrorMatches, `Unhealthy components: etcd-0 \(connection refused\), controller-manager \(\)`)
+}
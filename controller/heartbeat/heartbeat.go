@@ -0,0 +1,107 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	heartbeatInterval = 30 * time.Second
+	msgConnected      = "Agent connected"
+)
+
+// AgentInfo describes the running agent, it's written to the cluster's utils.AgentInfoAnnotation.
+type AgentInfo struct {
+	Version     string   `json:"version"`
+	GoVersion   string   `json:"goVersion"`
+	Platform    string   `json:"platform"`
+	Controllers []string `json:"controllers"`
+	// HeartbeatIntervalSeconds is how often the AgentConnected condition is refreshed, the cluster manager considers
+	// the agent lost when it's not refreshed for a few intervals.
+	HeartbeatIntervalSeconds int `json:"heartbeatIntervalSeconds"`
+}
+
+type Heartbeat struct {
+	clusterName   string
+	Clusters      v3.ClusterInterface
+	restClient    rest.Interface
+	clusterLister v3.ClusterLister
+	info          string
+}
+
+func Register(ctx context.Context, cluster *config.ClusterContext, version string, controllers []string) {
+	info, err := json.Marshal(AgentInfo{
+		Version:                  version,
+		GoVersion:                runtime.Version(),
+		Platform:                 runtime.GOOS + "/" + runtime.GOARCH,
+		Controllers:              controllers,
+		HeartbeatIntervalSeconds: int(heartbeatInterval / time.Second),
+	})
+	if err != nil {
+		logrus.Warnf("Error encoding agent info %v", err)
+	}
+
+	h := &Heartbeat{
+		clusterName:   cluster.ClusterName,
+		Clusters:      cluster.Management.Management.Clusters(""),
+		restClient:    cluster.Management.Management.RESTClient(),
+		clusterLister: cluster.Management.Management.Clusters("").Controller().Lister(),
+		info:          string(info),
+	}
+
+	go h.beat(ctx, heartbeatInterval)
+}
+
+func (h *Heartbeat) beat(ctx context.Context, interval time.Duration) {
+	for range utils.TickerContext(ctx, interval) {
+		if err := h.updateHeartbeat(interval); err != nil {
+			logrus.Warn(err)
+		}
+	}
+}
+
+// updateHeartbeat marks the agent connected and moves the condition's update time, and records the agent info.
+func (h *Heartbeat) updateHeartbeat(interval time.Duration) error {
+	cluster, err := h.clusterLister.Get("", h.clusterName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed to get cluster [%s] %v", h.clusterName, err)
+	}
+	if cluster.DeletionTimestamp != nil {
+		return nil
+	}
+
+	err = utils.UpdateCluster(h.restClient, h.Clusters, cluster, func(cluster *v3.Cluster) bool {
+		changed := false
+		// half the interval leaves room for the ticker's jitter, a full interval would skip every other beat
+		if utils.SetClusterCondition(cluster, utils.ClusterConditionAgentConnected, v1.ConditionTrue, msgConnected, "") ||
+			utils.TouchClusterCondition(cluster, utils.ClusterConditionAgentConnected, interval/2) {
+			changed = true
+		}
+		if cluster.Annotations[utils.AgentInfoAnnotation] != h.info {
+			if cluster.Annotations == nil {
+				cluster.Annotations = map[string]string{}
+			}
+			cluster.Annotations[utils.AgentInfoAnnotation] = h.info
+			changed = true
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update heartbeat of cluster [%s] %v", h.clusterName, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package nodesyncer
+
+import (
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	pendingMachineIndex = "cluster.cattle.io/pending-machine"
+	// machineNameAnnotation on a node names the Machine it was provisioned for.
+	machineNameAnnotation = "io.cattle.machine.name"
+
+	machineConditionProvisioned = "Provisioned"
+)
+
+// machineMatcher reports whether a pending Machine was provisioned for the node.
+type machineMatcher func(node *v1.Node, machine *v3.Machine) bool
+
+// adoptionMatchers are tried in order, the first one that matches exactly one Machine wins.
+var adoptionMatchers = []machineMatcher{
+	func(node *v1.Node, machine *v3.Machine) bool {
+		return node.Annotations[machineNameAnnotation] == machine.Name
+	},
+	func(node *v1.Node, machine *v3.Machine) bool {
+		return node.Spec.ProviderID != "" && node.Spec.ProviderID == machine.Spec.NodeSpec.ProviderID
+	},
+	func(node *v1.Node, machine *v3.Machine) bool {
+		hostname := nodeAddress(node.Status.Addresses, v1.NodeHostName)
+		if hostname == "" {
+			hostname = node.Labels["kubernetes.io/hostname"]
+		}
+		return hostname != "" && (hostname == machine.Name || hostname == nodeAddress(machine.Status.NodeStatus.Addresses, v1.NodeHostName))
+	},
+	func(node *v1.Node, machine *v3.Machine) bool {
+		ip := nodeAddress(node.Status.Addresses, v1.NodeInternalIP)
+		return ip != "" && ip == nodeAddress(machine.Status.NodeStatus.Addresses, v1.NodeInternalIP)
+	},
+}
+
+// findPendingClusterNode returns the Machine of this cluster that was provisioned for the node before the node
+// registered, if there is one.
+func (n *NodeSyncer) findPendingClusterNode(node *v1.Node) (*v3.Machine, error) {
+	objs, err := n.machineIndexer.ByIndex(pendingMachineIndex, n.clusterName)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+
+	for _, matches := range adoptionMatchers {
+		var found []*v3.Machine
+		for _, obj := range objs {
+			if machine, ok := obj.(*v3.Machine); ok && machine.DeletionTimestamp == nil && matches(node, machine) {
+				found = append(found, machine)
+			}
+		}
+		// more than one match is ambiguous, better to leave the machines alone than to bind the wrong one
+		if len(found) == 1 {
+			return found[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// adoptionConditions marks an adopted Machine as provisioned on top of the conditions taken from its node.
+func adoptionConditions(machine *v3.Machine, node *v1.Node) []v3.MachineCondition {
+	conditions, _ := setMachineCondition(machine.Status.Conditions, machineConditionProvisioned, v1.ConditionTrue, "")
+	return nodeConditions(conditions, node)
+}
+
+func nodeAddress(addresses []v1.NodeAddress, addressType v1.NodeAddressType) string {
+	for _, address := range addresses {
+		if address.Type == addressType {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+func pendingMachine(obj interface{}) ([]string, error) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Status.NodeName != "" || machine.Spec.ClusterName == "" {
+		return []string{}, nil
+	}
+	return []string{machine.Spec.ClusterName}, nil
+}
@@ -0,0 +1,137 @@
+package nodesyncer
+
+import (
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	machineConditionReachable = "Reachable"
+	// nodeHeartbeatTimeout is how long a node can go without a heartbeat from its kubelet before the Machine is marked
+	// unreachable. The node controller marks the node NotReady after 40 seconds by default.
+	nodeHeartbeatTimeout = 2 * time.Minute
+
+	msgNodeUnreachable = "Kubelet stopped posting node status"
+)
+
+// syncedNodeConditions are copied from the node to the Machine under the same type.
+var syncedNodeConditions = []v1.NodeConditionType{
+	v1.NodeReady,
+	v1.NodeDiskPressure,
+	v1.NodeMemoryPressure,
+	v1.NodeNetworkUnavailable,
+}
+
+// nodeConditions returns the conditions with the ones derived from the node's conditions and heartbeats set. A
+// transition takes the time the node reported for it, so it isn't delayed by the agent's sync.
+func nodeConditions(conditions []v3.MachineCondition, node *v1.Node) []v3.MachineCondition {
+	var lastHeartbeat time.Time
+	for _, conditionType := range syncedNodeConditions {
+		status, reason := v1.ConditionUnknown, ""
+		var transitionTime string
+		for _, nodeCondition := range node.Status.Conditions {
+			if nodeCondition.Type != conditionType {
+				continue
+			}
+			status, reason = nodeCondition.Status, nodeCondition.Message
+			if reason == "" {
+				reason = nodeCondition.Reason
+			}
+			if !nodeCondition.LastTransitionTime.IsZero() {
+				transitionTime = nodeCondition.LastTransitionTime.UTC().Format(time.RFC3339)
+			}
+			if nodeCondition.LastHeartbeatTime.After(lastHeartbeat) {
+				lastHeartbeat = nodeCondition.LastHeartbeatTime.Time
+			}
+		}
+		conditions = setMachineConditionAt(conditions, string(conditionType), status, reason, transitionTime)
+	}
+
+	reachable, reason := v1.ConditionTrue, ""
+	if isNodeUnreachable(node, lastHeartbeat) {
+		reachable, reason = v1.ConditionFalse, msgNodeUnreachable
+	}
+	conditions, _ = setMachineCondition(conditions, machineConditionReachable, reachable, reason)
+	return conditions
+}
+
+// isNodeUnreachable reports whether the kubelet lost contact, either because the node controller noticed it already or
+// because the last heartbeat is too old.
+func isNodeUnreachable(node *v1.Node, lastHeartbeat time.Time) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady && condition.Status == v1.ConditionUnknown {
+			return true
+		}
+	}
+	return !lastHeartbeat.IsZero() && time.Since(lastHeartbeat) > nodeHeartbeatTimeout
+}
+
+// setMachineConditionAt sets the condition like setMachineCondition, recording transitionTime as the time of the
+// transition if the status changed and transitionTime is known.
+func setMachineConditionAt(conditions []v3.MachineCondition, conditionType string, status v1.ConditionStatus, reason, transitionTime string) []v3.MachineCondition {
+	previous := machineConditionStatus(conditions, conditionType)
+	conditions, changed := setMachineCondition(conditions, conditionType, status, reason)
+	if !changed || previous == status || transitionTime == "" {
+		return conditions
+	}
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			conditions[i].LastTransitionTime = transitionTime
+		}
+	}
+	return conditions
+}
+
+func machineConditionStatus(conditions []v3.MachineCondition, conditionType string) v1.ConditionStatus {
+	for _, condition := range conditions {
+		if condition.Type == conditionType {
+			return condition.Status
+		}
+	}
+	return ""
+}
+
+// setMachineCondition returns a copy of the conditions with the condition set and reports whether it changed. The
+// update time only moves when the status or reason changes so that syncing doesn't rewrite unchanged conditions.
+func setMachineCondition(conditions []v3.MachineCondition, conditionType string, status v1.ConditionStatus, reason string) ([]v3.MachineCondition, bool) {
+	result := make([]v3.MachineCondition, len(conditions))
+	copy(result, conditions)
+	currTime := time.Now().UTC().Format(time.RFC3339)
+
+	for i, condition := range result {
+		if condition.Type != conditionType {
+			continue
+		}
+		if condition.Status == status && condition.Reason == reason {
+			return result, false
+		}
+		if condition.Status != status {
+			condition.LastTransitionTime = currTime
+		}
+		condition.Status = status
+		condition.Reason = reason
+		condition.LastUpdateTime = currTime
+		result[i] = condition
+		return result, true
+	}
+
+	return append(result, v3.MachineCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		LastUpdateTime:     currTime,
+		LastTransitionTime: currTime,
+	}), true
+}
+
+func removeMachineCondition(conditions []v3.MachineCondition, conditionType string) []v3.MachineCondition {
+	var result []v3.MachineCondition
+	for _, condition := range conditions {
+		if condition.Type != conditionType {
+			result = append(result, condition)
+		}
+	}
+	return result
+}
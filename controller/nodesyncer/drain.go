@@ -0,0 +1,317 @@
+package nodesyncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// nodeActionAnnotation on a Machine asks the agent to cordon, drain or uncordon the node.
+	nodeActionAnnotation = "io.cattle.node.action"
+	// drainOptionsAnnotation on a Machine holds the JSON encoded drainOptions used for a drain.
+	drainOptionsAnnotation = "io.cattle.node.drain-options"
+
+	nodeActionCordon   = "cordon"
+	nodeActionDrain    = "drain"
+	nodeActionUncordon = "uncordon"
+
+	machineConditionCordoned = "Cordoned"
+	machineConditionDrained  = "Drained"
+
+	defaultDrainTimeout = 10 * time.Minute
+	// drainRetryInterval is how long a failed drain waits before it's tried again.
+	drainRetryInterval    = time.Minute
+	evictionRetryInterval = 5 * time.Second
+
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+	msgDraining         = "Draining node"
+)
+
+// drainOptions mirrors the options of kubectl drain.
+type drainOptions struct {
+	// TimeoutSeconds is how long the drain may take, 10 minutes if not set.
+	TimeoutSeconds int64 `json:"timeoutSeconds,omitempty"`
+	// GracePeriodSeconds overrides the grace period of the evicted pods if set.
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
+	// IgnoreDaemonSets leaves pods managed by a DaemonSet alone instead of failing the drain.
+	IgnoreDaemonSets bool `json:"ignoreDaemonSets,omitempty"`
+	// DeleteLocalData evicts pods using emptyDir volumes instead of failing the drain.
+	DeleteLocalData bool `json:"deleteLocalData,omitempty"`
+	// Force evicts pods that aren't managed by a controller instead of failing the drain.
+	Force bool `json:"force,omitempty"`
+}
+
+// drainState is the progress of a drain, kept in memory and written to the Machine's Drained condition by the sync.
+type drainState struct {
+	status   v1.ConditionStatus
+	reason   string
+	finished time.Time
+	cancel   context.CancelFunc
+}
+
+type drainer struct {
+	sync.Mutex
+	// ctx stops the running drains when the agent shuts down
+	ctx       context.Context
+	k8sClient kubernetes.Interface
+	states    map[string]*drainState
+	// done is called with the node name when a drain finishes
+	done func(nodeName string)
+}
+
+func newDrainer(ctx context.Context, k8sClient kubernetes.Interface, done func(nodeName string)) *drainer {
+	return &drainer{
+		ctx:       ctx,
+		k8sClient: k8sClient,
+		states:    map[string]*drainState{},
+		done:      done,
+	}
+}
+
+// applyNodeAction carries out the action requested on the Machine and returns the node and conditions that reflect it.
+func (n *NodeSyncer) applyNodeAction(machine *v3.Machine, node *v1.Node, conditions []v3.MachineCondition) (*v1.Node, []v3.MachineCondition, error) {
+	action := machine.Annotations[nodeActionAnnotation]
+	if action != nodeActionDrain {
+		n.drainer.cancel(node.Name)
+	}
+
+	switch action {
+	case nodeActionCordon, nodeActionDrain:
+		updated, err := n.setUnschedulable(node, true)
+		if err != nil {
+			conditions, _ = setMachineCondition(conditions, machineConditionCordoned, v1.ConditionFalse, err.Error())
+			return node, conditions, err
+		}
+		node = updated
+	case nodeActionUncordon:
+		updated, err := n.setUnschedulable(node, false)
+		if err != nil {
+			conditions, _ = setMachineCondition(conditions, machineConditionCordoned, v1.ConditionTrue, err.Error())
+			return node, conditions, err
+		}
+		node = updated
+	case "":
+	default:
+		logrus.Warnf("Unknown node action [%s] on cluster node [%s]", action, machine.Name)
+	}
+
+	cordoned := v1.ConditionFalse
+	if node.Spec.Unschedulable {
+		cordoned = v1.ConditionTrue
+	}
+	conditions, _ = setMachineCondition(conditions, machineConditionCordoned, cordoned, "")
+
+	switch action {
+	case nodeActionDrain:
+		options := drainOptions{}
+		if value := machine.Annotations[drainOptionsAnnotation]; value != "" {
+			if err := json.Unmarshal([]byte(value), &options); err != nil {
+				conditions, _ = setMachineCondition(conditions, machineConditionDrained, v1.ConditionFalse,
+					fmt.Sprintf("invalid drain options: %v", err))
+				return node, conditions, nil
+			}
+		}
+		status, reason := n.drainer.drain(node.Name, options, machineConditionStatus(conditions, machineConditionDrained))
+		conditions, _ = setMachineCondition(conditions, machineConditionDrained, status, reason)
+	default:
+		conditions = removeMachineCondition(conditions, machineConditionDrained)
+	}
+	return node, conditions, nil
+}
+
+func (n *NodeSyncer) setUnschedulable(node *v1.Node, unschedulable bool) (*v1.Node, error) {
+	if node.Spec.Unschedulable == unschedulable {
+		return node, nil
+	}
+	updated := node.DeepCopy()
+	updated.Spec.Unschedulable = unschedulable
+	result, err := n.nodes.Update(updated)
+	if err != nil {
+		return node, errors.Wrapf(err, "couldn't set node %v unschedulable to %v", node.Name, unschedulable)
+	}
+	return result, nil
+}
+
+// drain starts draining the node unless the drain is already running or done, and returns its progress. A failed drain
+// is started again after drainRetryInterval.
+func (d *drainer) drain(nodeName string, options drainOptions, current v1.ConditionStatus) (v1.ConditionStatus, string) {
+	d.Lock()
+	defer d.Unlock()
+
+	state := d.states[nodeName]
+	if state == nil && current == v1.ConditionTrue {
+		// drained before the agent restarted
+		return v1.ConditionTrue, ""
+	}
+	if state != nil && (state.status != v1.ConditionFalse || time.Since(state.finished) < drainRetryInterval) {
+		return state.status, state.reason
+	}
+
+	timeout := defaultDrainTimeout
+	if options.TimeoutSeconds > 0 {
+		timeout = time.Duration(options.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	state = &drainState{
+		status: v1.ConditionUnknown,
+		reason: msgDraining,
+		cancel: cancel,
+	}
+	d.states[nodeName] = state
+
+	logrus.Infof("Draining node [%s]", nodeName)
+	go func() {
+		defer cancel()
+		err := d.evictPods(ctx, nodeName, options)
+
+		d.Lock()
+		if d.states[nodeName] != state || d.ctx.Err() != nil {
+			// cancelled, or the agent is shutting down
+			d.Unlock()
+			return
+		}
+		state.finished = time.Now()
+		if err != nil {
+			logrus.Warnf("Error draining node [%s] %v", nodeName, err)
+			state.status, state.reason = v1.ConditionFalse, err.Error()
+		} else {
+			logrus.Infof("Drained node [%s]", nodeName)
+			state.status, state.reason = v1.ConditionTrue, ""
+		}
+		d.Unlock()
+		d.done(nodeName)
+	}()
+	return state.status, state.reason
+}
+
+// cancel stops a running drain of the node and forgets its progress.
+func (d *drainer) cancel(nodeName string) {
+	d.Lock()
+	defer d.Unlock()
+	if state := d.states[nodeName]; state != nil {
+		state.cancel()
+		delete(d.states, nodeName)
+	}
+}
+
+// evictPods evicts the pods on the node through the eviction API, so pod disruption budgets are respected, and waits
+// for them to be gone.
+func (d *drainer) evictPods(ctx context.Context, nodeName string, options drainOptions) error {
+	pods, err := d.podsToEvict(nodeName, options)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		if err := d.evictPod(ctx, pod, options); err != nil {
+			return err
+		}
+	}
+
+	for _, pod := range pods {
+		if err := d.waitForDelete(ctx, pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// podsToEvict returns the pods of the node to evict, or an error naming the pods that can't be evicted with the given
+// options.
+func (d *drainer) podsToEvict(nodeName string, options drainOptions) ([]v1.Pod, error) {
+	podList, err := d.k8sClient.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName}).String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list pods of node %v", nodeName)
+	}
+
+	var pods []v1.Pod
+	for _, pod := range podList.Items {
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			continue
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+
+		controllerRef := metav1.GetControllerOf(&pod)
+		if controllerRef != nil && controllerRef.Kind == "DaemonSet" {
+			if options.IgnoreDaemonSets {
+				continue
+			}
+			return nil, errors.Errorf("pod %s/%s is managed by a DaemonSet, set ignoreDaemonSets to drain anyway", pod.Namespace, pod.Name)
+		}
+		if controllerRef == nil && !options.Force {
+			return nil, errors.Errorf("pod %s/%s is not managed by a controller, set force to drain anyway", pod.Namespace, pod.Name)
+		}
+		if hasLocalData(&pod) && !options.DeleteLocalData {
+			return nil, errors.Errorf("pod %s/%s uses local data, set deleteLocalData to drain anyway", pod.Namespace, pod.Name)
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func (d *drainer) evictPod(ctx context.Context, pod v1.Pod, options drainOptions) error {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &metav1.DeleteOptions{
+			GracePeriodSeconds: options.GracePeriodSeconds,
+		},
+	}
+	for {
+		err := d.k8sClient.CoreV1().Pods(pod.Namespace).Evict(eviction)
+		if err == nil || apierrors.IsNotFound(err) {
+			return nil
+		}
+		if !apierrors.IsTooManyRequests(err) {
+			return errors.Wrapf(err, "couldn't evict pod %s/%s", pod.Namespace, pod.Name)
+		}
+		// a disruption budget doesn't allow the eviction right now
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("stopped evicting pod %s/%s (%v): %v", pod.Namespace, pod.Name, ctx.Err(), err)
+		case <-time.After(evictionRetryInterval):
+		}
+	}
+}
+
+func (d *drainer) waitForDelete(ctx context.Context, pod v1.Pod) error {
+	for {
+		current, err := d.k8sClient.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("stopped waiting for pod %s/%s to be deleted: %v", pod.Namespace, pod.Name, ctx.Err())
+		case <-time.After(evictionRetryInterval):
+		}
+	}
+}
+
+func hasLocalData(pod *v1.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package nodesyncer
+
+import (
+	"strings"
+)
+
+// defaultAnnotationExcludes are never copied to Machines, they change all the time or carry data the management plane
+// has no use for.
+var defaultAnnotationExcludes = []string{
+	"node.alpha.kubernetes.io/ttl",
+	"volumes.kubernetes.io/",
+	"csi.volume.kubernetes.io/",
+	"flannel.alpha.coreos.com/backend-data",
+	reverseSyncedLabelsAnnotation,
+	reverseSyncedTaintsAnnotation,
+}
+
+// Options holds the settings of the node syncer.
+type Options struct {
+	// LabelFilter selects the node labels copied to the Machine.
+	LabelFilter KeyFilter
+	// AnnotationFilter selects the node annotations copied to the Machine, on top of defaultAnnotationExcludes.
+	AnnotationFilter KeyFilter
+	// ReverseSync applies the labels and taints set on the Machine by the management plane to the node.
+	ReverseSync bool
+}
+
+// KeyFilter selects keys by prefix. A key is allowed if it matches none of the Exclude prefixes and, when Include is
+// not empty, at least one of the Include prefixes.
+type KeyFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f KeyFilter) Allowed(key string) bool {
+	if hasAnyPrefix(key, f.Exclude) {
+		return false
+	}
+	return len(f.Include) == 0 || hasAnyPrefix(key, f.Include)
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package nodesyncer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	migrationRetryInterval = 30 * time.Second
+)
+
+// migrateClusterNodes labels the Machines of this cluster that were created before Machines were labeled with their
+// cluster. Only the label is written, and only to the version of the Machine that was listed; a Machine that changed
+// in the meantime fails the migration, which is retried.
+func (n *NodeSyncer) migrateClusterNodes() error {
+	machines, err := n.ClusterNodes.List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "couldn't list cluster nodes")
+	}
+
+	for _, machine := range machines.Items {
+		if machine.Spec.ClusterName != n.clusterName || machine.Labels[utils.ClusterNameLabel] == n.clusterName {
+			continue
+		}
+
+		patch, err := clusterNameLabelPatch(&machine, n.clusterName)
+		if err != nil {
+			return err
+		}
+		if err := patchMachine(n.restClient, machine.Name, patch); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "couldn't label cluster node %v", machine.Name)
+		}
+	}
+	return nil
+}
+
+// clusterNameLabelPatch returns the JSON patch setting the cluster name label of the Machine.
+func clusterNameLabelPatch(machine *v3.Machine, clusterName string) ([]byte, error) {
+	ops := []patchOperation{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: machine.ResourceVersion},
+	}
+	if machine.Labels == nil {
+		ops = append(ops, patchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]string{utils.ClusterNameLabel: clusterName}})
+	} else {
+		ops = append(ops, patchOperation{Op: "add", Path: "/metadata/labels/" + escapePathSegment(utils.ClusterNameLabel), Value: clusterName})
+	}
+	return json.Marshal(ops)
+}
+
+var pathSegmentEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escapePathSegment escapes a map key for use in a JSON pointer (RFC 6901).
+func escapePathSegment(segment string) string {
+	return pathSegmentEscaper.Replace(segment)
+}
@@ -1,8 +1,12 @@
 package nodesyncer
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/rancher/cluster-agent/metrics"
+	"github.com/rancher/cluster-agent/utils"
+	corev1 "github.com/rancher/types/apis/core/v1"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
@@ -10,22 +14,66 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	machineByNodeIndex = "cluster.cattle.io/machine-by-node"
+	// nodeUIDLabel links a Machine to the UID of the node it was created for, so a node recreated under the same name
+	// can be told apart from the one it replaces.
+	nodeUIDLabel = "io.cattle.node.uid"
 )
 
 type NodeSyncer struct {
-	ClusterNodes v3.MachineInterface
-	Clusters     v3.ClusterInterface
-	clusterName  string
+	ClusterNodes   v3.MachineInterface
+	restClient     rest.Interface
+	Clusters       v3.ClusterInterface
+	machineIndexer cache.Indexer
+	nodes          corev1.NodeInterface
+	nodeController corev1.NodeController
+	drainer        *drainer
+	clusterName    string
+	opts           Options
 }
 
-func Register(workload *config.ClusterContext) {
+func Register(ctx context.Context, workload *config.ClusterContext, opts Options) {
+	machineInformer := workload.Management.Management.Machines("").Controller().Informer()
+	machineInformer.AddIndexers(cache.Indexers{
+		machineByNodeIndex:  machineByNode,
+		pendingMachineIndex: pendingMachine,
+	})
+
 	n := &NodeSyncer{
-		clusterName:  workload.ClusterName,
-		ClusterNodes: workload.Management.Management.Machines(""),
-		Clusters:     workload.Management.Management.Clusters(""),
+		clusterName:    workload.ClusterName,
+		ClusterNodes:   workload.Management.Management.Machines(""),
+		restClient:     workload.Management.Management.RESTClient(),
+		Clusters:       workload.Management.Management.Clusters(""),
+		machineIndexer: machineInformer.GetIndexer(),
+		nodes:          workload.Core.Nodes(""),
+		nodeController: workload.Core.Nodes("").Controller(),
+		opts:           opts,
 	}
+	// copied so the caller's slice isn't appended to
+	n.opts.AnnotationFilter.Exclude = append(append([]string{}, opts.AnnotationFilter.Exclude...), defaultAnnotationExcludes...)
+
+	n.drainer = newDrainer(ctx, workload.K8sClient, func(nodeName string) {
+		n.nodeController.Enqueue("", nodeName)
+	})
+
+	n.nodeController.AddHandler(func(key string, node *v1.Node) error {
+		done := metrics.ObserveHandler("nodesyncer", "nodes")
+		return done(n.sync(key, node))
+	})
+	metrics.ManagedObjects.With("Machine").SetFunc(n.countClusterNodes)
+	// node actions and reverse synced labels are requested on the Machine
+	machineInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			n.enqueueMachineNode(obj)
+		},
+	})
 
-	workload.Core.Nodes("").Controller().AddHandler(n.sync)
+	go utils.RetryContext(ctx, migrationRetryInterval, "Migrating cluster nodes", n.migrateClusterNodes)
 }
 
 func (n *NodeSyncer) sync(key string, node *v1.Node) error {
@@ -36,40 +84,57 @@ func (n *NodeSyncer) sync(key string, node *v1.Node) error {
 }
 
 func (n *NodeSyncer) deleteClusterNode(nodeName string) error {
-	clusterNode, err := n.getClusterNode(nodeName)
+	clusterNodes, err := n.getClusterNodes(nodeName)
 	if err != nil {
 		return err
 	}
 	logrus.Infof("Deleting cluster node [%s]", nodeName)
 
-	if clusterNode == nil {
-		logrus.Infof("ClusterNode [%s] is already deleted")
+	if len(clusterNodes) == 0 {
+		logrus.Infof("ClusterNode [%s] is already deleted", nodeName)
 		return nil
 	}
-	err = n.ClusterNodes.Delete(clusterNode.ObjectMeta.Name, nil)
-	if err != nil {
-		return fmt.Errorf("Failed to delete cluster node [%s] %v", nodeName, err)
+	for _, clusterNode := range clusterNodes {
+		err = n.ClusterNodes.Delete(clusterNode.ObjectMeta.Name, nil)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("Failed to delete cluster node [%s] %v", nodeName, err)
+		}
 	}
 	logrus.Infof("Deleted cluster node [%s]", nodeName)
 	return nil
 }
 
-func (n *NodeSyncer) getClusterNode(nodeName string) (*v3.Machine, error) {
-	nodes, err := n.ClusterNodes.List(metav1.ListOptions{})
+// getClusterNodes returns the Machines of this cluster for the node from the Machine cache.
+func (n *NodeSyncer) getClusterNodes(nodeName string) ([]*v3.Machine, error) {
+	objs, err := n.machineIndexer.ByIndex(machineByNodeIndex, machineByNodeKey(n.clusterName, nodeName))
 	if err != nil {
 		return nil, err
 	}
-	for _, node := range nodes.Items {
-		if node.Status.NodeName == nodeName {
-			return &node, nil
+	var machines []*v3.Machine
+	for _, obj := range objs {
+		if machine, ok := obj.(*v3.Machine); ok {
+			machines = append(machines, machine)
 		}
 	}
+	return machines, nil
+}
 
-	return nil, nil
+// getClusterNode returns the Machine of this cluster for the node, preferring the one labeled with the node's UID.
+func (n *NodeSyncer) getClusterNode(node *v1.Node) (*v3.Machine, error) {
+	machines, err := n.getClusterNodes(node.Name)
+	if err != nil || len(machines) == 0 {
+		return nil, err
+	}
+	for _, machine := range machines {
+		if machine.Labels[nodeUIDLabel] == string(node.UID) {
+			return machine, nil
+		}
+	}
+	return machines[0], nil
 }
 
 func (n *NodeSyncer) createOrUpdateClusterNode(node *v1.Node) error {
-	existing, err := n.getClusterNode(node.Name)
+	existing, err := n.getClusterNode(node)
 	if err != nil {
 		return err
 	}
@@ -85,28 +150,50 @@ func (n *NodeSyncer) createOrUpdateClusterNode(node *v1.Node) error {
 	if cluster.ObjectMeta.DeletionTimestamp != nil {
 		return nil
 	}
+	var conditions []v3.MachineCondition
+	var actionErr error
+	if existing == nil {
+		existing, err = n.findPendingClusterNode(node)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			logrus.Infof("Adopting cluster node [%s] for node [%s]", existing.Name, node.Name)
+			conditions = adoptionConditions(existing, node)
+		}
+	}
+	if existing != nil {
+		if n.opts.ReverseSync {
+			if node, err = n.reverseSync(existing, node); err != nil {
+				return err
+			}
+		}
+		if conditions == nil {
+			conditions = nodeConditions(existing.Status.Conditions, node)
+		}
+		// the conditions report a failed action, so they're written before the error is returned
+		node, conditions, actionErr = n.applyNodeAction(existing, node, conditions)
+	}
 	if existing == nil {
 		logrus.Infof("Creating cluster node [%s]", node.Name)
 		clusterNode.Status.Requested = make(map[v1.ResourceName]resource.Quantity)
 		clusterNode.Status.Limits = make(map[v1.ResourceName]resource.Quantity)
+		clusterNode.Status.Conditions = nodeConditions(nil, node)
 		_, err := n.ClusterNodes.Create(clusterNode)
 		if err != nil {
 			return fmt.Errorf("Failed to create cluster node [%s] %v", node.Name, err)
 		}
 		logrus.Infof("Created cluster node [%s]", node.Name)
 	} else {
-		logrus.Infof("Updating cluster node [%s]", node.Name)
-		clusterNode.ResourceVersion = existing.ResourceVersion
-		clusterNode.Name = existing.Name
-		clusterNode.Status.Requested = existing.Status.Requested
-		clusterNode.Status.Limits = existing.Status.Limits
-		_, err := n.ClusterNodes.Update(clusterNode)
+		patched, err := n.patchClusterNode(existing, node, n.syncedLabels(node), n.syncedAnnotations(node), conditions)
 		if err != nil {
 			return fmt.Errorf("Failed to update cluster node [%s] %v", node.Name, err)
 		}
-		logrus.Infof("Updated cluster node [%s]", node.Name)
+		if patched {
+			logrus.Infof("Updated cluster node [%s]", node.Name)
+		}
 	}
-	return nil
+	return actionErr
 }
 
 func (n *NodeSyncer) convertNodeToClusterNode(node *v1.Node, cluster *v3.Cluster) *v3.Machine {
@@ -125,10 +212,14 @@ func (n *NodeSyncer) convertNodeToClusterNode(node *v1.Node, cluster *v3.Cluster
 	clusterNode.Kind = "Machine"
 	clusterNode.Spec.ClusterName = n.clusterName
 	clusterNode.Status.NodeName = node.Name
+	labels := n.syncedLabels(node)
+	annotations := n.syncedAnnotations(node)
+	annotations[syncedAnnotationsAnnotation] = syncedKeys(annotations)
+	annotations[syncedLabelsAnnotation] = syncedKeys(labels)
 	clusterNode.ObjectMeta = metav1.ObjectMeta{
 		GenerateName: "machine-",
-		Labels:       node.Labels,
-		Annotations:  node.Annotations,
+		Labels:       labels,
+		Annotations:  annotations,
 	}
 	ref := metav1.OwnerReference{
 		Name:       n.clusterName,
@@ -139,3 +230,55 @@ func (n *NodeSyncer) convertNodeToClusterNode(node *v1.Node, cluster *v3.Cluster
 	clusterNode.OwnerReferences = append(clusterNode.OwnerReferences, ref)
 	return clusterNode
 }
+
+// syncedLabels returns the labels the Machine gets from the node, leaving out the ones applied from the Machine.
+func (n *NodeSyncer) syncedLabels(node *v1.Node) map[string]string {
+	fromMachine := map[string]bool{}
+	for _, key := range decodeKeys(node.Annotations[reverseSyncedLabelsAnnotation]) {
+		fromMachine[key] = true
+	}
+
+	labels := map[string]string{}
+	for key, value := range node.Labels {
+		if !fromMachine[key] && n.opts.LabelFilter.Allowed(key) {
+			labels[key] = value
+		}
+	}
+	labels[nodeUIDLabel] = string(node.UID)
+	labels[utils.ClusterNameLabel] = n.clusterName
+	return labels
+}
+
+// syncedAnnotations returns the annotations the Machine gets from the node.
+func (n *NodeSyncer) syncedAnnotations(node *v1.Node) map[string]string {
+	annotations := map[string]string{}
+	for key, value := range node.Annotations {
+		if n.opts.AnnotationFilter.Allowed(key) {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// countClusterNodes returns the number of Machines of this cluster in the Machine cache.
+func (n *NodeSyncer) countClusterNodes() float64 {
+	count := 0
+	for _, obj := range n.machineIndexer.List() {
+		if machine, ok := obj.(*v3.Machine); ok && machine.Spec.ClusterName == n.clusterName {
+			count++
+		}
+	}
+	return float64(count)
+}
+
+func machineByNode(obj interface{}) ([]string, error) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Status.NodeName == "" {
+		return []string{}, nil
+	}
+	return []string{machineByNodeKey(machine.Spec.ClusterName, machine.Status.NodeName)}, nil
+}
+
+func machineByNodeKey(clusterName, nodeName string) string {
+	return clusterName + "/" + nodeName
+}
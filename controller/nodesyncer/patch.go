@@ -0,0 +1,142 @@
+package nodesyncer
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// syncedLabelsAnnotation and syncedAnnotationsAnnotation hold the keys copied from the node, so keys removed from
+	// the node can be removed from the Machine without touching the ones set by the management plane.
+	syncedLabelsAnnotation      = "io.cattle.node.synced-labels"
+	syncedAnnotationsAnnotation = "io.cattle.node.synced-annotations"
+)
+
+var patchBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 10 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// patchClusterNode writes the node derived fields to the Machine, leaving provisioning data and the labels and
+// annotations owned by the management plane alone. Conditions are only written when given. nodeSpec and nodeStatus are
+// replaced as a whole, so fields cleared on the node are cleared on the Machine as well. The patch only applies to the
+// version of the Machine it was computed from; when the Machine changed in the meantime it is read again and the patch
+// recomputed.
+func (n *NodeSyncer) patchClusterNode(existing *v3.Machine, node *v1.Node, labels, annotations map[string]string, conditions []v3.MachineCondition) (bool, error) {
+	patched := false
+	err := wait.ExponentialBackoff(patchBackoff, func() (bool, error) {
+		patch, changed, err := clusterNodePatch(existing, node, labels, annotations, conditions)
+		patched = changed
+		if err != nil || !changed {
+			return true, err
+		}
+		err = patchMachine(n.restClient, existing.Name, patch)
+		if err == nil {
+			return true, nil
+		}
+		latest, getErr := n.ClusterNodes.Get(existing.Name, metav1.GetOptions{})
+		if getErr != nil || latest.ResourceVersion == existing.ResourceVersion {
+			return false, err
+		}
+		existing = latest
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		err = errors.Errorf("conflict patching machine %v", existing.Name)
+	}
+	return patched, err
+}
+
+// patchOperation is a JSON patch (RFC 6902) operation.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// clusterNodePatch returns the JSON patch writing the node derived fields to the Machine and whether anything differs.
+func clusterNodePatch(existing *v3.Machine, node *v1.Node, labels, annotations map[string]string, conditions []v3.MachineCondition) ([]byte, bool, error) {
+	mergedLabels, labelsChanged := mergeKeys(existing.Labels, existing.Annotations[syncedLabelsAnnotation], labels)
+	mergedAnnotations, annotationsChanged := mergeKeys(existing.Annotations, existing.Annotations[syncedAnnotationsAnnotation], annotations)
+	conditionsChanged := conditions != nil && !reflect.DeepEqual(existing.Status.Conditions, conditions)
+	_, tracked := existing.Annotations[syncedLabelsAnnotation]
+	if tracked && !labelsChanged && !annotationsChanged && !conditionsChanged && existing.Status.NodeName == node.Name &&
+		reflect.DeepEqual(existing.Spec.NodeSpec, node.Spec) && reflect.DeepEqual(existing.Status.NodeStatus, node.Status) {
+		return nil, false, nil
+	}
+
+	mergedAnnotations[syncedLabelsAnnotation] = syncedKeys(labels)
+	mergedAnnotations[syncedAnnotationsAnnotation] = syncedKeys(annotations)
+	ops := []patchOperation{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: existing.ResourceVersion},
+		// labels and annotations may be missing altogether, add replaces them when they aren't
+		{Op: "add", Path: "/metadata/labels", Value: mergedLabels},
+		{Op: "add", Path: "/metadata/annotations", Value: mergedAnnotations},
+		// the fields are missing from Machines created without a status, add sets or replaces them
+		{Op: "add", Path: "/spec/nodeSpec", Value: node.Spec},
+		{Op: "add", Path: "/status/nodeStatus", Value: node.Status},
+		{Op: "add", Path: "/status/nodeName", Value: node.Name},
+	}
+	if conditions != nil {
+		ops = append(ops, patchOperation{Op: "add", Path: "/status/conditions", Value: conditions})
+	}
+	patch, err := json.Marshal(ops)
+	return patch, true, err
+}
+
+func patchMachine(restClient rest.Interface, name string, patch []byte) error {
+	return restClient.Patch(types.JSONPatchType).
+		Prefix("apis", v3.MachineGroupVersionKind.Group, v3.MachineGroupVersionKind.Version).
+		Resource(v3.MachineResource.Name).
+		Name(name).
+		Body(patch).
+		Do().
+		Error()
+}
+
+// mergeKeys returns current with its synced keys turned into desired, dropping the keys that are no longer synced, and
+// reports whether anything differs.
+func mergeKeys(current map[string]string, previouslySynced string, desired map[string]string) (map[string]string, bool) {
+	merged := map[string]string{}
+	for key, value := range current {
+		merged[key] = value
+	}
+	changed := false
+	for _, key := range decodeKeys(previouslySynced) {
+		if _, ok := desired[key]; !ok {
+			if _, ok := merged[key]; ok {
+				delete(merged, key)
+				changed = true
+			}
+		}
+	}
+	for key, value := range desired {
+		if currentValue, ok := merged[key]; !ok || currentValue != value {
+			merged[key] = value
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+func syncedKeys(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data, _ := json.Marshal(keys)
+	return string(data)
+}
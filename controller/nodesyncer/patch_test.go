@@ -0,0 +1,160 @@
+package nodesyncer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type PatchSuite struct{}
+
+var _ = check.Suite(&PatchSuite{})
+
+// applyPatch applies the JSON patch to the Machine the way the apiserver does, for the operations the node syncer uses.
+func applyPatch(c *check.C, machine *v3.Machine, patch []byte) *v3.Machine {
+	data, err := json.Marshal(machine)
+	c.Assert(err, check.IsNil)
+	return applyPatchToJSON(c, string(data), patch)
+}
+
+// applyPatchToJSON applies the JSON patch to a Machine given as JSON, which may leave out fields the type always has.
+func applyPatchToJSON(c *check.C, machine string, patch []byte) *v3.Machine {
+	doc := map[string]interface{}{}
+	c.Assert(json.Unmarshal([]byte(machine), &doc), check.IsNil)
+
+	var ops []patchOperation
+	c.Assert(json.Unmarshal(patch, &ops), check.IsNil)
+	for _, op := range ops {
+		segments := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		parent := doc
+		for _, segment := range segments[:len(segments)-1] {
+			child, ok := parent[segment].(map[string]interface{})
+			c.Assert(ok, check.Equals, true, check.Commentf("missing parent of %v", op.Path))
+			parent = child
+		}
+		last := strings.NewReplacer("~1", "/", "~0", "~").Replace(segments[len(segments)-1])
+		switch op.Op {
+		case "test":
+			c.Assert(parent[last], check.DeepEquals, op.Value)
+		case "add":
+			parent[last] = op.Value
+		default:
+			c.Fatalf("unexpected operation %v", op.Op)
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	c.Assert(err, check.IsNil)
+	result := &v3.Machine{}
+	c.Assert(json.Unmarshal(data, result), check.IsNil)
+	return result
+}
+
+func (s *PatchSuite) TestUncordonClearsUnschedulable(c *check.C) {
+	labels := map[string]string{"kubernetes.io/hostname": "node1"}
+	annotations := map[string]string{}
+
+	cordoned := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec: v1.NodeSpec{
+			Unschedulable: true,
+			ProviderID:    "aws:///i-1",
+			Taints: []v1.Taint{
+				{Key: "node.kubernetes.io/unschedulable", Effect: v1.TaintEffectNoSchedule},
+			},
+		},
+	}
+	machine := &v3.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine-1", ResourceVersion: "1"}}
+	patch, changed, err := clusterNodePatch(machine, cordoned, labels, annotations, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, true)
+	machine = applyPatch(c, machine, patch)
+	c.Assert(machine.Spec.NodeSpec.Unschedulable, check.Equals, true)
+	machine.ResourceVersion = "2"
+
+	uncordoned := cordoned.DeepCopy()
+	uncordoned.Spec.Unschedulable = false
+	uncordoned.Spec.Taints = nil
+	uncordoned.Spec.ProviderID = ""
+	patch, changed, err = clusterNodePatch(machine, uncordoned, labels, annotations, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, true)
+	machine = applyPatch(c, machine, patch)
+
+	c.Assert(machine.Spec.NodeSpec.Unschedulable, check.Equals, false)
+	c.Assert(machine.Spec.NodeSpec.Taints, check.HasLen, 0)
+	c.Assert(machine.Spec.NodeSpec.ProviderID, check.Equals, "")
+
+	// the Machine now matches the node, so it isn't patched again
+	machine.ResourceVersion = "3"
+	_, changed, err = clusterNodePatch(machine, uncordoned, labels, annotations, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, false)
+}
+
+func (s *PatchSuite) TestPatchIsGuardedByResourceVersion(c *check.C) {
+	machine := &v3.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine-1", ResourceVersion: "42"}}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+
+	patch, _, err := clusterNodePatch(machine, node, map[string]string{}, map[string]string{}, nil)
+	c.Assert(err, check.IsNil)
+	var ops []patchOperation
+	c.Assert(json.Unmarshal(patch, &ops), check.IsNil)
+	c.Assert(ops[0], check.DeepEquals, patchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: "42"})
+}
+
+func (s *PatchSuite) TestMergeKeysKeepsManagementKeys(c *check.C) {
+	current := map[string]string{"from-node": "a", "removed": "b", "management": "c"}
+	merged, changed := mergeKeys(current, `["from-node","removed"]`, map[string]string{"from-node": "a2"})
+
+	c.Assert(changed, check.Equals, true)
+	c.Assert(merged, check.DeepEquals, map[string]string{"from-node": "a2", "management": "c"})
+	// current is not modified, it usually comes from the cache
+	c.Assert(current["removed"], check.Equals, "b")
+}
+
+func (s *PatchSuite) TestPatchesPendingMachineWithoutNodeFields(c *check.C) {
+	// a Machine created through the management API before its node registered
+	pending := `{"metadata":{"name":"machine-1","resourceVersion":"5"},"spec":{"clusterName":"c1"},"status":{}}`
+	machine := &v3.Machine{}
+	c.Assert(json.Unmarshal([]byte(pending), machine), check.IsNil)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "aws:///i-1"},
+	}
+	conditions := []v3.MachineCondition{{Type: "Ready", Status: v1.ConditionTrue}}
+
+	patch, changed, err := clusterNodePatch(machine, node, map[string]string{}, map[string]string{}, conditions)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, true)
+	machine = applyPatchToJSON(c, pending, patch)
+
+	c.Assert(machine.Status.NodeName, check.Equals, "node1")
+	c.Assert(machine.Spec.NodeSpec.ProviderID, check.Equals, "aws:///i-1")
+	c.Assert(machine.Status.Conditions, check.HasLen, 1)
+	c.Assert(machine.Spec.ClusterName, check.Equals, "c1")
+}
+
+func (s *PatchSuite) TestMigrationOnlySetsTheClusterLabel(c *check.C) {
+	unlabelled := `{"metadata":{"name":"machine-1","resourceVersion":"5"},"spec":{"clusterName":"c1"},"status":{}}`
+	machine := &v3.Machine{}
+	c.Assert(json.Unmarshal([]byte(unlabelled), machine), check.IsNil)
+
+	patch, err := clusterNameLabelPatch(machine, "c1")
+	c.Assert(err, check.IsNil)
+	c.Assert(applyPatchToJSON(c, unlabelled, patch).Labels, check.DeepEquals, map[string]string{utils.ClusterNameLabel: "c1"})
+
+	labelled := `{"metadata":{"name":"machine-1","resourceVersion":"6","labels":{"other":"x"}},"spec":{"clusterName":"c1"}}`
+	c.Assert(json.Unmarshal([]byte(labelled), machine), check.IsNil)
+	patch, err = clusterNameLabelPatch(machine, "c1")
+	c.Assert(err, check.IsNil)
+	c.Assert(applyPatchToJSON(c, labelled, patch).Labels, check.DeepEquals, map[string]string{"other": "x", utils.ClusterNameLabel: "c1"})
+}
@@ -0,0 +1,146 @@
+package nodesyncer
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/utils"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// desiredTaintsAnnotation on a Machine holds the JSON list of taints the management plane wants on the node. The
+	// Machine's NodeSpec can't be used for that, it mirrors the node.
+	desiredTaintsAnnotation = "io.cattle.node.taints"
+	// reverseSyncedLabelsAnnotation and reverseSyncedTaintsAnnotation on a node hold the label keys and taints applied
+	// from the Machine, so they can be removed again when they're removed from the Machine, and so they aren't copied
+	// back up as node labels.
+	reverseSyncedLabelsAnnotation = "io.cattle.machine.synced-labels"
+	reverseSyncedTaintsAnnotation = "io.cattle.machine.synced-taints"
+)
+
+// enqueueMachineNode syncs the node of a Machine of this cluster when the Machine changes.
+func (n *NodeSyncer) enqueueMachineNode(obj interface{}) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Spec.ClusterName != n.clusterName || machine.Status.NodeName == "" {
+		return
+	}
+	n.nodeController.Enqueue("", machine.Status.NodeName)
+}
+
+// reverseSync applies the labels and taints set on the Machine by the management plane to the node and returns the
+// updated node. Labels on the Machine that came from the node stay owned by the node, so only keys the node doesn't
+// have can be set from the management plane.
+func (n *NodeSyncer) reverseSync(machine *v3.Machine, node *v1.Node) (*v1.Node, error) {
+	updated := node.DeepCopy()
+	if updated.Labels == nil {
+		updated.Labels = map[string]string{}
+	}
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+
+	labels := managementLabels(machine, node)
+	for _, key := range decodeKeys(node.Annotations[reverseSyncedLabelsAnnotation]) {
+		if _, ok := labels[key]; !ok {
+			delete(updated.Labels, key)
+		}
+	}
+	for key, value := range labels {
+		updated.Labels[key] = value
+	}
+	updated.Annotations[reverseSyncedLabelsAnnotation] = syncedKeys(labels)
+
+	var taints []v1.Taint
+	if value := machine.Annotations[desiredTaintsAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &taints); err != nil {
+			return node, errors.Wrapf(err, "invalid taints on machine %v", machine.Name)
+		}
+	}
+	previous := decodeKeys(node.Annotations[reverseSyncedTaintsAnnotation])
+	updated.Spec.Taints = mergeTaints(node.Spec.Taints, previous, taints)
+	updated.Annotations[reverseSyncedTaintsAnnotation] = taintKeys(taints)
+
+	if reflect.DeepEqual(node.Labels, updated.Labels) && reflect.DeepEqual(node.Annotations, updated.Annotations) &&
+		reflect.DeepEqual(node.Spec.Taints, updated.Spec.Taints) {
+		return node, nil
+	}
+	result, err := n.nodes.Update(updated)
+	if err != nil {
+		return node, errors.Wrapf(err, "couldn't apply machine %v labels and taints to node %v", machine.Name, node.Name)
+	}
+	return result, nil
+}
+
+// managementLabels returns the labels of the Machine that weren't copied from the node. Machines created before the
+// copied labels were tracked have no record of them, the labels the node currently has are taken as copied then, until
+// the record is written with the next patch of the Machine.
+func managementLabels(machine *v3.Machine, node *v1.Node) map[string]string {
+	fromNode := map[string]bool{
+		nodeUIDLabel:           true,
+		utils.ClusterNameLabel: true,
+	}
+	if synced, ok := machine.Annotations[syncedLabelsAnnotation]; ok {
+		for _, key := range decodeKeys(synced) {
+			fromNode[key] = true
+		}
+	} else {
+		for key := range node.Labels {
+			fromNode[key] = true
+		}
+	}
+
+	labels := map[string]string{}
+	for key, value := range machine.Labels {
+		if !fromNode[key] {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// mergeTaints removes the previously applied taints from the node's taints and adds the desired ones.
+func mergeTaints(current []v1.Taint, previous []string, desired []v1.Taint) []v1.Taint {
+	if len(previous) == 0 && len(desired) == 0 {
+		return current
+	}
+	drop := map[string]bool{}
+	for _, key := range previous {
+		drop[key] = true
+	}
+	for _, taint := range desired {
+		drop[taintKey(taint)] = true
+	}
+
+	var result []v1.Taint
+	for _, taint := range current {
+		if !drop[taintKey(taint)] {
+			result = append(result, taint)
+		}
+	}
+	return append(result, desired...)
+}
+
+func taintKey(taint v1.Taint) string {
+	return taint.Key + ":" + string(taint.Effect)
+}
+
+func taintKeys(taints []v1.Taint) string {
+	keys := make([]string, 0, len(taints))
+	for _, taint := range taints {
+		keys = append(keys, taintKey(taint))
+	}
+	sort.Strings(keys)
+	data, _ := json.Marshal(keys)
+	return string(data)
+}
+
+func decodeKeys(value string) []string {
+	var keys []string
+	// a malformed annotation is treated as empty and overwritten
+	json.Unmarshal([]byte(value), &keys)
+	return keys
+}
@@ -0,0 +1,37 @@
+package nodesyncer
+
+import (
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ReverseSuite struct{}
+
+var _ = check.Suite(&ReverseSuite{})
+
+func (s *ReverseSuite) TestUntrackedMachineLabelsStayWithTheNode(c *check.C) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node1",
+		Labels: map[string]string{"kubernetes.io/hostname": "node1", "zone": "a"},
+	}}
+	machine := &v3.Machine{ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{"kubernetes.io/hostname": "node1", "zone": "a", "team": "x"},
+	}}
+
+	c.Assert(managementLabels(machine, node), check.DeepEquals, map[string]string{"team": "x"})
+}
+
+func (s *ReverseSuite) TestTrackedMachineLabels(c *check.C) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node1",
+		Labels: map[string]string{"kubernetes.io/hostname": "node1", "team": "x"},
+	}}
+	machine := &v3.Machine{ObjectMeta: metav1.ObjectMeta{
+		Labels:      map[string]string{"kubernetes.io/hostname": "node1", "team": "x", nodeUIDLabel: "uid"},
+		Annotations: map[string]string{syncedLabelsAnnotation: `["kubernetes.io/hostname"]`},
+	}}
+
+	c.Assert(managementLabels(machine, node), check.DeepEquals, map[string]string{"team": "x"})
+}
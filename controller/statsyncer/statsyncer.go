@@ -2,50 +2,184 @@ package statsyncer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/rancher/cluster-agent/metrics"
 	"github.com/rancher/cluster-agent/utils"
+	corev1 "github.com/rancher/types/apis/core/v1"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 const (
-	syncInterval = 5 * time.Second
+	syncInterval      = 5 * time.Second
+	podsByNodeIndex   = "cluster.cattle.io/pods-by-node"
+	machineWriteQPS   = 5
+	machineWriteBurst = 10
+	msgDiskPressure   = "Nodes under disk pressure"
+	msgMemoryPressure = "Nodes under memory pressure"
 )
 
+var patchBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 10 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// StatSyncer keeps running totals of the requests and limits of the pods on every node, fed by the pod and node
+// informers, and periodically writes the totals that changed to the node's Machine and to the Cluster.
 type StatSyncer struct {
-	clusterName  string
-	Clusters     v3.ClusterInterface
-	ClusterNodes v3.MachineInterface
-	Pods         corev1.PodInterface
-	Nodes        corev1.NodeInterface
+	clusterName   string
+	Clusters      v3.ClusterInterface
+	restClient    rest.Interface
+	ClusterNodes  v3.MachineInterface
+	clusterLister v3.ClusterLister
+	machineLister v3.MachineLister
+	nodeLister    corev1.NodeLister
+	podIndexer    cache.Indexer
+	writeLimiter  flowcontrol.RateLimiter
+
+	totalsLock sync.Mutex
+	nodeTotals map[string]*nodeResources
+}
+
+// nodeResources holds the summed requests and limits of the non terminated pods of a node
+type nodeResources struct {
+	requests map[v1.ResourceName]resource.Quantity
+	limits   map[v1.ResourceName]resource.Quantity
 }
 
 func Register(ctx context.Context, cluster *config.ClusterContext) {
+	podInformer := cluster.Core.Pods("").Controller().Informer()
+	podInformer.AddIndexers(cache.Indexers{
+		podsByNodeIndex: podsByNode,
+	})
+
 	s := &StatSyncer{
-		clusterName:  cluster.ClusterName,
-		Clusters:     cluster.Management.Management.Clusters(""),
-		ClusterNodes: cluster.Management.Management.Machines(""),
-		Pods:         cluster.K8sClient.CoreV1().Pods(""),
-		Nodes:        cluster.K8sClient.CoreV1().Nodes(),
+		clusterName:   cluster.ClusterName,
+		Clusters:      cluster.Management.Management.Clusters(""),
+		restClient:    cluster.Management.Management.RESTClient(),
+		ClusterNodes:  cluster.Management.Management.Machines(""),
+		clusterLister: cluster.Management.Management.Clusters("").Controller().Lister(),
+		machineLister: cluster.Management.Management.Machines("").Controller().Lister(),
+		nodeLister:    cluster.Core.Nodes("").Controller().Lister(),
+		podIndexer:    podInformer.GetIndexer(),
+		writeLimiter:  flowcontrol.NewTokenBucketRateLimiter(machineWriteQPS, machineWriteBurst),
+		nodeTotals:    map[string]*nodeResources{},
 	}
 
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.podChanged,
+		UpdateFunc: func(old, obj interface{}) {
+			oldPod, oldOK := old.(*v1.Pod)
+			pod, ok := obj.(*v1.Pod)
+			if oldOK && ok && oldPod.Spec.NodeName != pod.Spec.NodeName {
+				s.podChanged(old)
+			}
+			s.podChanged(obj)
+		},
+		DeleteFunc: s.podChanged,
+	})
+	cluster.Core.Nodes("").Controller().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.nodeAdded,
+		DeleteFunc: s.nodeDeleted,
+	})
+
 	go s.syncResources(ctx, syncInterval)
 }
 
+func (s *StatSyncer) podChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.NodeName == "" {
+		return
+	}
+	s.recomputeNode(pod.Spec.NodeName)
+}
+
+func (s *StatSyncer) nodeAdded(obj interface{}) {
+	if node, ok := obj.(*v1.Node); ok {
+		s.recomputeNode(node.Name)
+	}
+}
+
+func (s *StatSyncer) nodeDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if node, ok := obj.(*v1.Node); ok {
+		s.totalsLock.Lock()
+		delete(s.nodeTotals, node.Name)
+		s.totalsLock.Unlock()
+	}
+}
+
+// recomputeNode sums up the requests and limits of the non terminated pods on the node from the pod cache.
+func (s *StatSyncer) recomputeNode(nodeName string) {
+	objs, err := s.podIndexer.ByIndex(podsByNodeIndex, nodeName)
+	if err != nil {
+		logrus.Warnf("Error getting pods of node [%s] %v", nodeName, err)
+		return
+	}
+
+	requests, limits := map[v1.ResourceName]resource.Quantity{}, map[v1.ResourceName]resource.Quantity{}
+	podCount := 0
+	for _, obj := range objs {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		podRequests, podLimits := s.getPodData(pod)
+		addMap(podRequests, requests)
+		addMap(podLimits, limits)
+		podCount++
+	}
+	requests[v1.ResourcePods] = *resource.NewQuantity(int64(podCount), resource.DecimalSI)
+
+	s.totalsLock.Lock()
+	defer s.totalsLock.Unlock()
+	s.nodeTotals[nodeName] = &nodeResources{
+		requests: requests,
+		limits:   limits,
+	}
+}
+
+func (s *StatSyncer) getNodeTotals() map[string]*nodeResources {
+	s.totalsLock.Lock()
+	defer s.totalsLock.Unlock()
+
+	// entries are replaced rather than modified, so a shallow copy is safe to read without the lock
+	totals := make(map[string]*nodeResources, len(s.nodeTotals))
+	for name, resources := range s.nodeTotals {
+		totals[name] = resources
+	}
+	return totals
+}
+
 func (s *StatSyncer) syncResources(ctx context.Context, syncInterval time.Duration) {
 	for range utils.TickerContext(ctx, syncInterval) {
-		err := s.syncClusterNodeResources()
-		logrus.Info("Syncing allocated resources")
+		done := metrics.ObserveSync("statsyncer")
+		err := done(s.syncClusterNodeResources())
+		logrus.Debug("Syncing allocated resources")
 		if err != nil {
 			logrus.Warn(err)
 		}
@@ -53,7 +187,7 @@ func (s *StatSyncer) syncResources(ctx context.Context, syncInterval time.Durati
 }
 
 func (s *StatSyncer) syncClusterNodeResources() error {
-	cluster, err := s.getCluster()
+	cluster, err := s.clusterLister.Get("", s.clusterName)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			logrus.Infof("Skip syncing node resources, cluster [%s] not found", s.clusterName)
@@ -61,119 +195,186 @@ func (s *StatSyncer) syncClusterNodeResources() error {
 		}
 		return err
 	}
-	if cluster == nil {
+	if cluster.DeletionTimestamp != nil {
 		logrus.Infof("Skip syncing node resources, cluster [%s] deleted", s.clusterName)
 		return nil
 	}
 	if !utils.IsClusterProvisioned(cluster) {
 		return fmt.Errorf("Skip syncing node resources - cluster [%s] not provisioned yet", s.clusterName)
 	}
-	nodes, err := s.Nodes.List(metav1.ListOptions{})
+	nodes, err := s.nodeLister.List("", labels.Everything())
 	if err != nil {
 		return fmt.Errorf("Skip syncing node resources - Error getting nodes %v", err)
 	}
-	cnodes, err := s.ClusterNodes.List(metav1.ListOptions{})
+	cnodes, err := s.machineLister.List("", labels.Everything())
 	if err != nil {
 		return fmt.Errorf("Skip syncing node resources - Error getting cluster nodes %v", err)
 	}
-	nodeNameToNode := s.getNodeMapping(nodes)
+	nodeNameToResources := s.getNodeTotals()
 
-	return s.updateClusterNodeResources(cnodes, nodeNameToNode)
+	if err := s.updateClusterNodeResources(cnodes, nodeNameToResources); err != nil {
+		return err
+	}
+	return s.updateClusterResources(cluster, nodes, nodeNameToResources)
 }
 
-func (s *StatSyncer) updateClusterNodeResources(cnodes *v3.MachineList, nodeNameToNode map[string]*v1.Node) error {
-	for _, cnode := range cnodes.Items {
-		node := nodeNameToNode[cnode.Status.NodeName]
-		if node == nil {
-			logrus.Warnf("Skip adding cluster node resources [%s] Error getting Node %v", cnode.Name, cnode.Status.NodeName)
+// updateClusterNodeResources writes the totals of the nodes whose Machine is out of date. Writes are rate limited,
+// machines that don't get a turn are picked up on a later sync.
+func (s *StatSyncer) updateClusterNodeResources(cnodes []*v3.Machine, nodeNameToResources map[string]*nodeResources) error {
+	for _, cnode := range cnodes {
+		if cnode.Spec.ClusterName != s.clusterName {
 			continue
 		}
-		pods, err := s.getNonTerminatedPods(node.Name)
-		if err != nil {
-			logrus.Warnf("Skip adding cluster node resources [%s] Error getting Pods %v", node.Name, err)
+		resources := nodeNameToResources[cnode.Status.NodeName]
+		if resources == nil {
 			continue
 		}
-		var nodeData map[string]map[string]map[v1.ResourceName]resource.Quantity
-		if pods != nil {
-			//podName -> req/limit -> data
-			nodeData = make(map[string]map[string]map[v1.ResourceName]resource.Quantity)
-			for _, pod := range pods.Items {
-				nodeData[pod.Name] = make(map[string]map[v1.ResourceName]resource.Quantity)
-				requests, limits := s.getPodData(&pod)
-				nodeData[pod.Name]["requests"] = requests
-				nodeData[pod.Name]["limits"] = limits
-			}
+		if !isClusterNodeChanged(cnode, resources.requests, resources.limits) {
+			continue
+		}
+		if !s.writeLimiter.TryAccept() {
+			logrus.Debugf("Deferring cluster node resources update [%s], write rate exceeded", cnode.Name)
+			continue
+		}
+		if err := s.updateClusterNode(cnode, resources.requests, resources.limits); err != nil {
+			logrus.Warnf("Error updating cluster node resources [%s] %v", cnode.Name, err)
+		}
+	}
+	return nil
+}
+
+// updateClusterResources rolls the capacity and allocatable resources of the nodes and the requests and limits of their
+// pods up to the cluster, and sets the cluster's disk and memory pressure conditions from the nodes' conditions.
+func (s *StatSyncer) updateClusterResources(cluster *v3.Cluster, nodes []*v1.Node, nodeNameToResources map[string]*nodeResources) error {
+	capacity, allocatable := v1.ResourceList{}, v1.ResourceList{}
+	requests, limits := v1.ResourceList{}, v1.ResourceList{}
+	var diskPressure, memoryPressure []string
+	for _, node := range nodes {
+		addMap(node.Status.Capacity, capacity)
+		addMap(node.Status.Allocatable, allocatable)
+		if resources := nodeNameToResources[node.Name]; resources != nil {
+			addMap(resources.requests, requests)
+			addMap(resources.limits, limits)
 		}
-		nodeRequests, nodeLimits := s.aggregate(nodeData)
-		nodeRequests[v1.ResourcePods] = *resource.NewQuantity(int64(len(pods.Items)), resource.DecimalSI)
-		if isClusterNodeChanged(&cnode, nodeRequests, nodeLimits) {
-			err = s.updateClusterNode(&cnode, nodeRequests, nodeLimits)
-			if err != nil {
-				logrus.Warnf("Error updating cluster node resources [%s] %v", cnode.Name, err)
+		for _, condition := range node.Status.Conditions {
+			if condition.Status != v1.ConditionTrue {
 				continue
 			}
+			switch condition.Type {
+			case v1.NodeDiskPressure:
+				diskPressure = append(diskPressure, node.Name)
+			case v1.NodeMemoryPressure:
+				memoryPressure = append(memoryPressure, node.Name)
+			}
+		}
+	}
+
+	err := utils.UpdateCluster(s.restClient, s.Clusters, cluster, func(cluster *v3.Cluster) bool {
+		changed := false
+		if !isEqual(capacity, cluster.Status.Capacity) || !isEqual(allocatable, cluster.Status.Allocatable) ||
+			!isEqual(requests, cluster.Status.Requested) || !isEqual(limits, cluster.Status.Limits) {
+			cluster.Status.Capacity = capacity
+			cluster.Status.Allocatable = allocatable
+			cluster.Status.Requested = requests
+			cluster.Status.Limits = limits
+			changed = true
+		}
+		if updatePressureCondition(cluster, v3.ClusterConditionNoDiskPressure, diskPressure, msgDiskPressure) {
+			changed = true
+		}
+		if updatePressureCondition(cluster, v3.ClusterConditionNoMemoryPressure, memoryPressure, msgMemoryPressure) {
+			changed = true
 		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update cluster [%s] resources %v", cluster.Name, err)
 	}
 	return nil
 }
 
+// updatePressureCondition sets the condition to True when no node is under pressure, and to False listing the nodes
+// that are otherwise. It reports whether the condition changed.
+func updatePressureCondition(cluster *v3.Cluster, conditionType v3.ClusterConditionType, nodeNames []string, msg string) bool {
+	if len(nodeNames) > 0 {
+		return utils.SetClusterCondition(cluster, conditionType, v1.ConditionFalse, msg, strings.Join(nodeNames, ", "))
+	}
+	return utils.SetClusterCondition(cluster, conditionType, v1.ConditionTrue, "", "")
+}
+
 func isClusterNodeChanged(cnode *v3.Machine, requests map[v1.ResourceName]resource.Quantity, limits map[v1.ResourceName]resource.Quantity) bool {
 	return !isEqual(requests, cnode.Status.Requested) || !isEqual(limits, cnode.Status.Limits)
 }
 
+// updateClusterNode writes the requests and limits to the Machine, leaving the fields written by the node syncer and
+// the management plane alone. The patch only applies to the version of the Machine it was computed from; when the
+// Machine changed in the meantime it is read again and written if still out of date.
 func (s *StatSyncer) updateClusterNode(cnode *v3.Machine, requests map[v1.ResourceName]resource.Quantity, limits map[v1.ResourceName]resource.Quantity) error {
-	if cnode.Status.Requested == nil {
-		cnode.Status.Requested = v1.ResourceList{}
-	}
-	if cnode.Status.Limits == nil {
-		cnode.Status.Limits = v1.ResourceList{}
-	}
-
-	for name, quantity := range requests {
-		cnode.Status.Requested[name] = quantity
-	}
-	for name, quantity := range limits {
-		cnode.Status.Limits[name] = quantity
+	err := wait.ExponentialBackoff(patchBackoff, func() (bool, error) {
+		if !isClusterNodeChanged(cnode, requests, limits) {
+			return true, nil
+		}
+		patch, err := clusterNodeResourcesPatch(cnode, requests, limits)
+		if err != nil {
+			return false, err
+		}
+		err = patchMachine(s.restClient, cnode.Name, patch)
+		if err == nil {
+			return true, nil
+		}
+		latest, getErr := s.ClusterNodes.Get(cnode.Name, metav1.GetOptions{})
+		if getErr != nil || latest.ResourceVersion == cnode.ResourceVersion {
+			return false, err
+		}
+		cnode = latest
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		err = errors.Errorf("conflict patching machine %v", cnode.Name)
 	}
-
-	_, err := s.ClusterNodes.Update(cnode)
 	return err
 }
 
-func (s *StatSyncer) getNonTerminatedPods(nodeName string) (*v1.PodList, error) {
-	fieldSelector, err := fields.ParseSelector("spec.nodeName=" + nodeName + ",status.phase!=Succeeded" + ",status.phase!=Failed")
-	if err != nil {
-		return nil, fmt.Errorf("Skip adding cluster node resources [%s] Error getting pods %v", nodeName, err)
-	}
-	nonTerminatedPodsList, err := s.Pods.List(metav1.ListOptions{FieldSelector: fieldSelector.String()})
-	if err != nil {
-		if !errors.IsForbidden(err) {
-			return nil, fmt.Errorf("Skip adding cluster node resources [%s] Access to pods forbidden %v", nodeName, err)
-		}
-	}
-	return nonTerminatedPodsList, nil
+// patchOperation is a JSON patch (RFC 6902) operation.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
 }
 
-func (s *StatSyncer) aggregate(data map[string]map[string]map[v1.ResourceName]resource.Quantity) (map[v1.ResourceName]resource.Quantity, map[v1.ResourceName]resource.Quantity) {
-	requests, limits := map[v1.ResourceName]resource.Quantity{}, map[v1.ResourceName]resource.Quantity{}
-	for _, podData := range data {
-		podRequests, podLimits := podData["requests"], podData["limits"]
-		addMap(podRequests, requests)
-		addMap(podLimits, limits)
-	}
-	return requests, limits
+// clusterNodeResourcesPatch returns the JSON patch replacing the requests and limits of the Machine, guarded by its
+// resourceVersion.
+func clusterNodeResourcesPatch(cnode *v3.Machine, requests map[v1.ResourceName]resource.Quantity, limits map[v1.ResourceName]resource.Quantity) ([]byte, error) {
+	updated := &v3.Machine{}
+	setClusterNodeResources(updated, requests, limits)
+	// the fields are left out of the Machine when empty, add creates or replaces them
+	return json.Marshal([]patchOperation{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: cnode.ResourceVersion},
+		{Op: "add", Path: "/status/requested", Value: updated.Status.Requested},
+		{Op: "add", Path: "/status/limits", Value: updated.Status.Limits},
+	})
 }
 
-func (s *StatSyncer) getCluster() (*v3.Cluster, error) {
-	return s.Clusters.Get(s.clusterName, metav1.GetOptions{})
+func patchMachine(restClient rest.Interface, name string, patch []byte) error {
+	return restClient.Patch(types.JSONPatchType).
+		Prefix("apis", v3.MachineGroupVersionKind.Group, v3.MachineGroupVersionKind.Version).
+		Resource(v3.MachineResource.Name).
+		Name(name).
+		Body(patch).
+		Do().
+		Error()
 }
 
-func (s *StatSyncer) getNodeMapping(nodes *v1.NodeList) map[string]*v1.Node {
-	nodeNameToNode := make(map[string]*v1.Node)
-	for _, node := range nodes.Items {
-		nodeNameToNode[node.Name] = &node
+// setClusterNodeResources replaces the requests and limits of the Machine, so resources no pod uses anymore are dropped.
+func setClusterNodeResources(cnode *v3.Machine, requests map[v1.ResourceName]resource.Quantity, limits map[v1.ResourceName]resource.Quantity) {
+	cnode.Status.Requested = v1.ResourceList{}
+	for name, quantity := range requests {
+		cnode.Status.Requested[name] = quantity
+	}
+	cnode.Status.Limits = v1.ResourceList{}
+	for name, quantity := range limits {
+		cnode.Status.Limits[name] = quantity
 	}
-	return nodeNameToNode
 }
 
 func (s *StatSyncer) getPodData(pod *v1.Pod) (map[v1.ResourceName]resource.Quantity, map[v1.ResourceName]resource.Quantity) {
@@ -191,10 +392,7 @@ func (s *StatSyncer) getPodData(pod *v1.Pod) (map[v1.ResourceName]resource.Quant
 }
 
 func isEqual(data1 map[v1.ResourceName]resource.Quantity, data2 map[v1.ResourceName]resource.Quantity) bool {
-	if data1 == nil && data2 == nil {
-		return true
-	}
-	if data1 == nil || data2 == nil {
+	if len(data1) != len(data2) {
 		return false
 	}
 	for key, value := range data1 {
@@ -202,7 +400,7 @@ func isEqual(data1 map[v1.ResourceName]resource.Quantity, data2 map[v1.ResourceN
 			return false
 		}
 		value2 := data2[key]
-		if value.Value() != value2.Value() {
+		if value.Cmp(value2) != 0 {
 			return false
 		}
 	}
@@ -232,3 +430,11 @@ func addMapForInit(data1 map[v1.ResourceName]resource.Quantity, data2 map[v1.Res
 		}
 	}
 }
+
+func podsByNode(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.NodeName == "" {
+		return []string{}, nil
+	}
+	return []string{pod.Spec.NodeName}, nil
+}
@@ -0,0 +1,86 @@
+package statsyncer
+
+import (
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type StatSyncerSuite struct{}
+
+var _ = check.Suite(&StatSyncerSuite{})
+
+func (s *StatSyncerSuite) TestShrinkingResourcesAreRemoved(c *check.C) {
+	cnode := &v3.Machine{}
+	cnode.Status.Requested = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("1"),
+		v1.ResourceMemory: resource.MustParse("1Gi"),
+		v1.ResourcePods:   resource.MustParse("3"),
+	}
+	cnode.Status.Limits = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("2"),
+		v1.ResourceMemory: resource.MustParse("2Gi"),
+	}
+
+	requests := map[v1.ResourceName]resource.Quantity{
+		v1.ResourceCPU:  resource.MustParse("1"),
+		v1.ResourcePods: resource.MustParse("2"),
+	}
+	limits := map[v1.ResourceName]resource.Quantity{
+		v1.ResourceCPU: resource.MustParse("2"),
+	}
+	c.Assert(isClusterNodeChanged(cnode, requests, limits), check.Equals, true)
+
+	setClusterNodeResources(cnode, requests, limits)
+
+	c.Assert(cnode.Status.Requested, check.HasLen, 2)
+	c.Assert(cnode.Status.Limits, check.HasLen, 1)
+	_, hasMemory := cnode.Status.Limits[v1.ResourceMemory]
+	c.Assert(hasMemory, check.Equals, false)
+	// the next sync with the same totals doesn't write the Machine again
+	c.Assert(isClusterNodeChanged(cnode, requests, limits), check.Equals, false)
+}
+
+func (s *StatSyncerSuite) TestSetResourcesDoesNotShareMaps(c *check.C) {
+	cnode := &v3.Machine{}
+	limits := map[v1.ResourceName]resource.Quantity{
+		v1.ResourceCPU: resource.MustParse("2"),
+	}
+
+	setClusterNodeResources(cnode, nil, limits)
+	delete(limits, v1.ResourceCPU)
+
+	c.Assert(cnode.Status.Requested, check.HasLen, 0)
+	c.Assert(cnode.Status.Limits, check.HasLen, 1)
+}
+
+func (s *StatSyncerSuite) TestMillicoreChangesAreDetected(c *check.C) {
+	cnode := &v3.Machine{}
+	cnode.Status.Requested = v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m")}
+
+	// both round up to one whole core, they still differ
+	requests := map[v1.ResourceName]resource.Quantity{v1.ResourceCPU: resource.MustParse("200m")}
+	c.Assert(isClusterNodeChanged(cnode, requests, nil), check.Equals, true)
+
+	// the same amount in another notation is no change
+	requests = map[v1.ResourceName]resource.Quantity{v1.ResourceCPU: resource.MustParse("0.1")}
+	c.Assert(isClusterNodeChanged(cnode, requests, nil), check.Equals, false)
+}
+
+func (s *StatSyncerSuite) TestResourcesPatchOnlyTouchesRequestsAndLimits(c *check.C) {
+	cnode := &v3.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine-1", ResourceVersion: "12"}}
+	requests := map[v1.ResourceName]resource.Quantity{v1.ResourceCPU: resource.MustParse("250m")}
+
+	patch, err := clusterNodeResourcesPatch(cnode, requests, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(patch), check.Equals, `[`+
+		`{"op":"test","path":"/metadata/resourceVersion","value":"12"},`+
+		`{"op":"add","path":"/status/requested","value":{"cpu":"250m"}},`+
+		`{"op":"add","path":"/status/limits","value":{}}]`)
+}
@@ -0,0 +1,191 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// recordAnnotation is the annotation used by the Kubernetes leader election, so the lock can be inspected with the
+	// usual tools.
+	recordAnnotation = "control-plane.alpha.kubernetes.io/leader"
+)
+
+// Config holds the settings of the leader election.
+type Config struct {
+	Client kubernetes.Interface
+	// Namespace and Name of the ConfigMap used as the lock.
+	Namespace string
+	Name      string
+	// Identity of this replica in the lock.
+	Identity string
+	// LeaseDuration is how long standby replicas wait after the last renewal before taking over.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew before it gives up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is the time between attempts to acquire or renew the lock.
+	RetryPeriod time.Duration
+}
+
+// ErrLeadershipLost is returned by Run when the lock couldn't be renewed in time.
+var ErrLeadershipLost = errors.New("lost leadership")
+
+// record is the content of the lock, compatible with the Kubernetes LeaderElectionRecord.
+type record struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+type elector struct {
+	config Config
+	// observed is the last record read from the lock and observedTime the local time it was first seen, leases are
+	// timed with the local clock so they don't depend on the clocks of the other replicas.
+	observed     record
+	observedTime time.Time
+}
+
+// Run blocks until this replica acquires the lock, then calls run with a context that is cancelled when leadership is
+// lost, and keeps renewing the lock. It returns ErrLeadershipLost once leadership is lost, or the context's error once
+// ctx is done.
+func Run(ctx context.Context, config Config, run func(ctx context.Context)) error {
+	e := &elector{config: config}
+
+	logrus.Infof("Waiting to become leader [%s/%s] as [%s]", config.Namespace, config.Name, config.Identity)
+	if !e.retry(ctx, 0, e.tryAcquireOrRenew) {
+		return ctx.Err()
+	}
+	logrus.Infof("Became leader [%s/%s] as [%s]", config.Namespace, config.Name, config.Identity)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go run(leaderCtx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(config.RetryPeriod):
+		}
+		if !e.retry(ctx, config.RenewDeadline, e.tryAcquireOrRenew) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.Warnf("Lost leadership [%s/%s] as [%s]", config.Namespace, config.Name, config.Identity)
+			return ErrLeadershipLost
+		}
+	}
+}
+
+// retry calls f every RetryPeriod until it succeeds, ctx is done or the timeout, if not 0, passes.
+func (e *elector) retry(ctx context.Context, timeout time.Duration, f func() (bool, error)) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for {
+		ok, err := f()
+		if err != nil {
+			logrus.Warnf("Error updating leader lock [%s/%s] %v", e.config.Namespace, e.config.Name, err)
+		}
+		if ok {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return false
+		case <-time.After(e.config.RetryPeriod):
+		}
+	}
+}
+
+// tryAcquireOrRenew takes the lock if it's free or expired, or renews it if it's held by this replica.
+func (e *elector) tryAcquireOrRenew() (bool, error) {
+	now := metav1.Now()
+	desired := record{
+		HolderIdentity:       e.config.Identity,
+		LeaseDurationSeconds: int(e.config.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	configMaps := e.config.Client.CoreV1().ConfigMaps(e.config.Namespace)
+	lock, err := configMaps.Get(e.config.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		value, err := json.Marshal(desired)
+		if err != nil {
+			return false, err
+		}
+		_, err = configMaps.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        e.config.Name,
+				Namespace:   e.config.Namespace,
+				Annotations: map[string]string{recordAnnotation: string(value)},
+			},
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't create configmap %v", e.config.Name)
+		}
+		e.observe(desired)
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't get configmap %v", e.config.Name)
+	}
+
+	var current record
+	if value := lock.Annotations[recordAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			return false, errors.Wrapf(err, "invalid leader record in configmap %v", e.config.Name)
+		}
+	}
+	if !reflect.DeepEqual(current, e.observed) {
+		e.observe(current)
+	}
+
+	held := current.HolderIdentity != "" && current.HolderIdentity != e.config.Identity
+	if held && e.observedTime.Add(time.Duration(current.LeaseDurationSeconds)*time.Second).After(time.Now()) {
+		return false, nil
+	}
+
+	if current.HolderIdentity == e.config.Identity {
+		desired.AcquireTime = current.AcquireTime
+		desired.LeaderTransitions = current.LeaderTransitions
+	} else {
+		desired.LeaderTransitions = current.LeaderTransitions + 1
+	}
+
+	value, err := json.Marshal(desired)
+	if err != nil {
+		return false, err
+	}
+	lock = lock.DeepCopy()
+	if lock.Annotations == nil {
+		lock.Annotations = map[string]string{}
+	}
+	lock.Annotations[recordAnnotation] = string(value)
+	// the update fails on a conflict if another replica changed the lock since it was read
+	if _, err := configMaps.Update(lock); err != nil {
+		return false, errors.Wrapf(err, "couldn't update configmap %v", e.config.Name)
+	}
+	e.observe(desired)
+	return true, nil
+}
+
+func (e *elector) observe(r record) {
+	e.observed = r
+	e.observedTime = time.Now()
+}
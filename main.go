@@ -2,17 +2,33 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/pkg/errors"
 	controller "github.com/rancher/cluster-agent/controller"
+	"github.com/rancher/cluster-agent/controller/eventssyncer"
+	"github.com/rancher/cluster-agent/controller/nodesyncer"
+	"github.com/rancher/cluster-agent/leader"
+	"github.com/rancher/cluster-agent/metrics"
+	"github.com/rancher/cluster-agent/utils"
+	normancontroller "github.com/rancher/norman/controller"
+	"github.com/rancher/norman/signal"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+var (
+	VERSION = "v0.0.0-dev"
+)
+
 func main() {
 	app := cli.NewApp()
+	app.Version = VERSION
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "cluster-manager-config",
@@ -26,13 +42,147 @@ func main() {
 			Name:  "cluster-name",
 			Usage: "name of the cluster",
 		},
+		cli.BoolFlag{
+			Name:  "role-gc-dry-run",
+			Usage: "only log the orphaned roles that would be deleted",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-label-include",
+			Usage: "prefix of the node labels copied to machines, all labels are copied if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-label-exclude",
+			Usage: "prefix of the node labels not copied to machines",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-annotation-include",
+			Usage: "prefix of the node annotations copied to machines, all annotations are copied if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-annotation-exclude",
+			Usage: "prefix of the node annotations not copied to machines",
+		},
+		cli.BoolFlag{
+			Name:  "leader-elect",
+			Usage: "elect a leader among the replicas of the agent, only the leader runs the controllers",
+		},
+		cli.DurationFlag{
+			Name:  "leader-elect-lease-duration",
+			Usage: "how long replicas on standby wait after the leader last renewed its lease before taking over",
+			Value: 15 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "leader-elect-renew-deadline",
+			Usage: "how long the leader tries to renew its lease before giving up leadership",
+			Value: 10 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "leader-elect-retry-period",
+			Usage: "time between attempts to acquire or renew the lease",
+			Value: 2 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "leader-elect-namespace",
+			Usage: "namespace of the leader election lock in the cluster",
+			Value: "kube-system",
+		},
+		cli.BoolFlag{
+			Name:  "node-reverse-sync",
+			Usage: "apply the labels and taints set on machines to their nodes",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-types",
+			Usage: "type of the events synced to the cluster manager, all types are synced if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-namespaces",
+			Usage: "namespace of the events synced to the cluster manager, all namespaces are synced if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-exclude-namespaces",
+			Usage: "namespace of the events not synced to the cluster manager",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-reasons",
+			Usage: "reason of the events synced to the cluster manager, all reasons are synced if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-exclude-reasons",
+			Usage: "reason of the events not synced to the cluster manager",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-kinds",
+			Usage: "involved object kind of the events synced to the cluster manager, all kinds are synced if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "event-exclude-kinds",
+			Usage: "involved object kind of the events not synced to the cluster manager",
+		},
+		cli.IntFlag{
+			Name:  "event-creates-per-minute",
+			Usage: "maximum number of cluster events created per minute, 0 for no limit",
+			Value: 120,
+		},
+		cli.DurationFlag{
+			Name:  "event-ttl",
+			Usage: "how long cluster events are kept after they last occurred, 0 to keep them forever",
+			Value: 24 * time.Hour,
+		},
+		cli.IntFlag{
+			Name:  "event-max-count",
+			Usage: "maximum number of cluster events kept for the cluster, 0 for no limit",
+			Value: 5000,
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "address to serve the prometheus metrics on at /metrics, e.g. :9091, metrics are not served if not set",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
+		if addr := c.String("metrics-listen"); addr != "" {
+			go serveMetrics(addr)
+		}
 		return runControllers(
 			c.String("cluster-manager-config"),
 			c.String("cluster-config"),
 			c.String("cluster-name"),
+			electionConfig(c),
+			controller.Options{
+				RoleGCDryRun: c.Bool("role-gc-dry-run"),
+				Version:      VERSION,
+				NodeSync: nodesyncer.Options{
+					LabelFilter: nodesyncer.KeyFilter{
+						Include: c.StringSlice("node-label-include"),
+						Exclude: c.StringSlice("node-label-exclude"),
+					},
+					AnnotationFilter: nodesyncer.KeyFilter{
+						Include: c.StringSlice("node-annotation-include"),
+						Exclude: c.StringSlice("node-annotation-exclude"),
+					},
+					ReverseSync: c.Bool("node-reverse-sync"),
+				},
+				EventSync: eventssyncer.Options{
+					Types: eventssyncer.Filter{
+						Include: c.StringSlice("event-types"),
+					},
+					Namespaces: eventssyncer.Filter{
+						Include: c.StringSlice("event-namespaces"),
+						Exclude: c.StringSlice("event-exclude-namespaces"),
+					},
+					Reasons: eventssyncer.Filter{
+						Include: c.StringSlice("event-reasons"),
+						Exclude: c.StringSlice("event-exclude-reasons"),
+					},
+					Kinds: eventssyncer.Filter{
+						Include: c.StringSlice("event-kinds"),
+						Exclude: c.StringSlice("event-exclude-kinds"),
+					},
+					CreatesPerMinute: c.Int("event-creates-per-minute"),
+					TTL:              c.Duration("event-ttl"),
+					MaxEvents:        c.Int("event-max-count"),
+				},
+			},
 		)
 	}
 
@@ -43,7 +193,34 @@ func main() {
 	app.Run(os.Args)
 }
 
-func runControllers(clusterManagerCfg string, clusterCfg string, clusterName string) error {
+func electionConfig(c *cli.Context) *leader.Config {
+	if !c.Bool("leader-elect") {
+		return nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "cluster-agent"
+	}
+	return &leader.Config{
+		Namespace:     c.String("leader-elect-namespace"),
+		Name:          "cluster-agent",
+		Identity:      fmt.Sprintf("%s_%d", hostname, os.Getpid()),
+		LeaseDuration: c.Duration("leader-elect-lease-duration"),
+		RenewDeadline: c.Duration("leader-elect-renew-deadline"),
+		RetryPeriod:   c.Duration("leader-elect-retry-period"),
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	logrus.Infof("Serving metrics on [%s]", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Fatalf("Failed to serve metrics on [%s] %v", addr, err)
+	}
+}
+
+func runControllers(clusterManagerCfg string, clusterCfg string, clusterName string, election *leader.Config, opts controller.Options) error {
 	clusterManagementKubeConfig, err := clientcmd.BuildConfigFromFlags("", clusterManagerCfg)
 	if err != nil {
 		return err
@@ -59,7 +236,45 @@ func runControllers(clusterManagerCfg string, clusterCfg string, clusterName str
 		return err
 	}
 
-	ctx := context.Background()
-	controller.Register(ctx, cluster)
-	return cluster.StartAndWait(ctx)
+	if election == nil {
+		ctx := context.Background()
+		controller.Register(ctx, cluster, opts)
+		return cluster.StartAndWait(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(signal.SigTermCancelContext(context.Background()))
+	defer cancel()
+	elected := make(chan struct{})
+	controller.Register(utils.WithElected(ctx, elected), cluster, opts)
+
+	// replicas on standby keep their caches in sync so they can take over right away, but only the leader runs the
+	// handlers
+	if err := normancontroller.Sync(ctx, cluster.Management.Management, cluster.Apps, cluster.Project, cluster.Core,
+		cluster.RBAC, cluster.Extensions); err != nil {
+		return err
+	}
+
+	election.Client = cluster.K8sClient
+	startErr := make(chan error, 1)
+	err = leader.Run(ctx, *election, func(ctx context.Context) {
+		close(elected)
+		if err := cluster.Start(ctx); err != nil {
+			startErr <- err
+			cancel()
+		}
+	})
+	select {
+	case err := <-startErr:
+		return errors.Wrap(err, "failed to start controllers")
+	default:
+	}
+	switch err {
+	case leader.ErrLeadershipLost:
+		// the controllers can't be stopped, the replica exits and joins the election again as a standby once restarted
+		logrus.Info("Exiting, no longer the leader")
+		return nil
+	case context.Canceled:
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	namespace = "cluster_agent"
+
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+	kindSummary = "summary"
+)
+
+var (
+	// HandlerDuration is the time the handlers of the controllers take to process an object, in seconds.
+	HandlerDuration = NewSummaryVec("handler_duration_seconds", "Time taken by a controller handler to process an object.", "controller", "handler")
+	// HandlerErrors counts the errors returned by the handlers of the controllers.
+	HandlerErrors = NewCounterVec("handler_errors_total", "Number of errors returned by a controller handler.", "controller", "handler")
+	// SyncDuration is the time a run of the periodic sync loops takes, in seconds.
+	SyncDuration = NewSummaryVec("sync_duration_seconds", "Time taken by a run of a sync loop.", "loop")
+	// SyncFailures counts the runs of the periodic sync loops that failed.
+	SyncFailures = NewCounterVec("sync_failures_total", "Number of failed runs of a sync loop.", "loop")
+	// ManagedObjects is the number of objects the agent manages for the cluster, by kind.
+	ManagedObjects = NewGaugeVec("managed_objects", "Number of objects managed by the agent.", "kind")
+)
+
+// labelValueEscaper escapes label values the way the text format expects them.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// registry holds the metric families served on /metrics.
+var registry = struct {
+	sync.Mutex
+	families []*family
+}{}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	family      *family
+	labelValues []string
+	// value is the counter or gauge value, or the sum of the observations of a summary
+	value float64
+	count uint64
+	// fn, when set, computes the gauge value when the metrics are collected
+	fn func() float64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{
+		name:   namespace + "_" + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.families = append(registry.families, f)
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects labels %v, got values %v", f.name, f.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{family: f, labelValues: labelValues}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) add(v float64) {
+	s.family.lock.Lock()
+	s.value += v
+	s.family.lock.Unlock()
+}
+
+// Counter is a value that only ever goes up.
+type Counter struct {
+	s *series
+}
+
+func (c Counter) Inc() {
+	c.s.add(1)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	s *series
+}
+
+func (g Gauge) Inc() {
+	g.s.add(1)
+}
+
+func (g Gauge) Dec() {
+	g.s.add(-1)
+}
+
+func (g Gauge) Set(v float64) {
+	g.s.family.lock.Lock()
+	g.s.value = v
+	g.s.family.lock.Unlock()
+}
+
+// SetFunc makes the gauge report the value returned by fn each time the metrics are collected.
+func (g Gauge) SetFunc(fn func() float64) {
+	g.s.family.lock.Lock()
+	g.s.fn = fn
+	g.s.family.lock.Unlock()
+}
+
+// Summary tracks the count and the sum of observations.
+type Summary struct {
+	s *series
+}
+
+func (m Summary) Observe(v float64) {
+	m.s.family.lock.Lock()
+	m.s.value += v
+	m.s.count++
+	m.s.family.lock.Unlock()
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{newFamily(name, help, kindCounter, labels)}
+}
+
+// With returns the counter for the label values, given in the order of the labels of the vector.
+func (v CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.f.with(labelValues)}
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{newFamily(name, help, kindGauge, labels)}
+}
+
+// With returns the gauge for the label values, given in the order of the labels of the vector.
+func (v GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.f.with(labelValues)}
+}
+
+type SummaryVec struct {
+	f *family
+}
+
+func NewSummaryVec(name, help string, labels ...string) SummaryVec {
+	return SummaryVec{newFamily(name, help, kindSummary, labels)}
+}
+
+// With returns the summary for the label values, given in the order of the labels of the vector.
+func (v SummaryVec) With(labelValues ...string) Summary {
+	return Summary{v.f.with(labelValues)}
+}
+
+// ObserveHandler starts timing a run of a controller handler. The returned func records the time taken and the error
+// of the run, and returns the error so the handler can be wrapped in a single statement.
+func ObserveHandler(controller, handler string) func(error) error {
+	return observe(HandlerDuration.With(controller, handler), HandlerErrors.With(controller, handler))
+}
+
+// ObserveSync starts timing a run of a sync loop. The returned func records the time taken and the error of the run,
+// and returns the error.
+func ObserveSync(loop string) func(error) error {
+	return observe(SyncDuration.With(loop), SyncFailures.With(loop))
+}
+
+func observe(duration Summary, failures Counter) func(error) error {
+	start := time.Now()
+	return func(err error) error {
+		duration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			failures.Inc()
+		}
+		return err
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := bufio.NewWriter(rw)
+		registry.Lock()
+		families := append([]*family{}, registry.families...)
+		registry.Unlock()
+		sort.Slice(families, func(i, j int) bool {
+			return families[i].name < families[j].name
+		})
+		for _, f := range families {
+			f.write(w)
+		}
+		w.Flush()
+	})
+}
+
+func (f *family) write(w *bufio.Writer) {
+	type sample struct {
+		labels string
+		value  float64
+		count  uint64
+		fn     func() float64
+	}
+
+	f.lock.Lock()
+	samples := make([]sample, 0, len(f.series))
+	for _, s := range f.series {
+		samples = append(samples, sample{
+			labels: formatLabels(f.labels, s.labelValues),
+			value:  s.value,
+			count:  s.count,
+			fn:     s.fn,
+		})
+	}
+	f.lock.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].labels < samples[j].labels
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range samples {
+		// gauge funcs are called without the lock, they usually read from the caches
+		if s.fn != nil {
+			s.value = s.fn()
+		}
+		if f.kind == kindSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, s.labels, formatValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, s.labels, s.count)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", f.name, s.labels, formatValue(s.value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type MetricsSuite struct{}
+
+var _ = check.Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) scrape(c *check.C) string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(rec.Code, check.Equals, 200)
+	return rec.Body.String()
+}
+
+func (s *MetricsSuite) TestCounterAndGauge(c *check.C) {
+	counter := NewCounterVec("test_counter_total", "A test counter.", "name")
+	counter.With("a").Inc()
+	counter.With("a").Inc()
+	gauge := NewGaugeVec("test_gauge", "A test gauge.", "name")
+	gauge.With("b").Inc()
+	gauge.With("b").Dec()
+	gauge.With(`quoted "c"`).Set(3)
+
+	out := s.scrape(c)
+	c.Assert(out, check.Matches, `(?s).*# HELP cluster_agent_test_counter_total A test counter.\n# TYPE cluster_agent_test_counter_total counter\ncluster_agent_test_counter_total\{name="a"\} 2\n.*`)
+	c.Assert(out, check.Matches, `(?s).*cluster_agent_test_gauge\{name="b"\} 0\ncluster_agent_test_gauge\{name="quoted \\"c\\""\} 3\n.*`)
+}
+
+func (s *MetricsSuite) TestGaugeFuncIsCalledOnScrape(c *check.C) {
+	value := 1.0
+	NewGaugeVec("test_gauge_func", "A test gauge func.", "kind").With("Machine").SetFunc(func() float64 { return value })
+
+	c.Assert(s.scrape(c), check.Matches, `(?s).*cluster_agent_test_gauge_func\{kind="Machine"\} 1\n.*`)
+	value = 5
+	c.Assert(s.scrape(c), check.Matches, `(?s).*cluster_agent_test_gauge_func\{kind="Machine"\} 5\n.*`)
+}
+
+func (s *MetricsSuite) TestObserveSyncCountsFailures(c *check.C) {
+	err := errors.New("failed")
+	c.Assert(ObserveSync("test-loop")(nil), check.IsNil)
+	c.Assert(ObserveSync("test-loop")(err), check.Equals, err)
+
+	out := s.scrape(c)
+	c.Assert(out, check.Matches, `(?s).*# TYPE cluster_agent_sync_duration_seconds summary\n.*cluster_agent_sync_duration_seconds_count\{loop="test-loop"\} 2\n.*`)
+	c.Assert(out, check.Matches, `(?s).*cluster_agent_sync_failures_total\{loop="test-loop"\} 1\n.*`)
+}
+
+func (s *MetricsSuite) TestEmptyFamiliesAreLeftOut(c *check.C) {
+	NewCounterVec("test_unused_total", "An unused counter.", "name")
+
+	c.Assert(s.scrape(c), check.Not(check.Matches), `(?s).*test_unused_total.*`)
+}
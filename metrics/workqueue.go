@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	workqueueDepth        = NewGaugeVec("workqueue_depth", "Current depth of a controller workqueue.", "name")
+	workqueueAdds         = NewCounterVec("workqueue_adds_total", "Number of adds handled by a controller workqueue.", "name")
+	workqueueLatency      = NewSummaryVec("workqueue_queue_latency_microseconds", "How long an item stays in a controller workqueue before being processed.", "name")
+	workqueueWorkDuration = NewSummaryVec("workqueue_work_duration_microseconds", "How long processing an item from a controller workqueue takes.", "name")
+	workqueueRetries      = NewCounterVec("workqueue_retries_total", "Number of retries handled by a controller workqueue.", "name")
+)
+
+// The workqueues of the controllers pick up their metrics when they are created, so the provider is set as soon as the
+// package is imported.
+func init() {
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.With(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.With(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return workqueueLatency.With(name)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return workqueueWorkDuration.With(name)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.With(name)
+}
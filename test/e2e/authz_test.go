@@ -2,6 +2,7 @@ package e2e
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/rancher/cluster-agent/controller/authz"
@@ -9,9 +10,11 @@ import (
 	authzv1 "github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"gopkg.in/check.v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	extclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
@@ -34,7 +37,6 @@ func (s *AuthzSuite) TestClusterRoleTemplateBindingCreate(c *check.C) {
 
 	// create RoleTemplate (this one will be referenced by the next one)
 	podRORoleTemplateName := "testsubcrt1"
-	s.clusterClient.RbacV1().ClusterRoles().Delete(podRORoleTemplateName, &metav1.DeleteOptions{})
 	subRT, err := s.createRoleTemplate(podRORoleTemplateName,
 		[]rbacv1.PolicyRule{
 			{
@@ -49,7 +51,6 @@ func (s *AuthzSuite) TestClusterRoleTemplateBindingCreate(c *check.C) {
 
 	// create RoleTemplate that will reference the first one
 	rtName := "testcrt1"
-	s.clusterClient.RbacV1().ClusterRoles().Delete(rtName, &metav1.DeleteOptions{})
 	rt, err := s.createRoleTemplate(rtName,
 		[]rbacv1.PolicyRule{
 			{
@@ -135,7 +136,6 @@ func (s *AuthzSuite) TestRoleTemplateBindingCreate(c *check.C) {
 
 	// create RoleTemplate (this one will be referenced by the next one)
 	podRORoleTemplateName := "testsubrt1"
-	s.clusterClient.RbacV1().ClusterRoles().Delete(podRORoleTemplateName, &metav1.DeleteOptions{})
 	subRT, err := s.createRoleTemplate(podRORoleTemplateName,
 		[]rbacv1.PolicyRule{
 			{
@@ -150,7 +150,6 @@ func (s *AuthzSuite) TestRoleTemplateBindingCreate(c *check.C) {
 
 	// create RoleTemplate that will reference the first one
 	rtName := "testrt1"
-	s.clusterClient.RbacV1().ClusterRoles().Delete(rtName, &metav1.DeleteOptions{})
 	rt, err := s.createRoleTemplate(rtName,
 		[]rbacv1.PolicyRule{
 			{
@@ -236,9 +235,17 @@ func (s *AuthzSuite) TestBuiltinRoleTemplateBindingCreate(c *check.C) {
 	// create project
 	projectName := "testproject2"
 
-	// create RoleTemplate that user will be bound to
+	// create RoleTemplate that user will be bound to, along with the builtin role it stands for
 	rtName := "testrt2"
-	_, err := s.createRoleTemplate(rtName,
+	_, err := s.clusterClient.RbacV1().ClusterRoles().Create(&rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: rtName,
+		},
+	})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		c.Fatal(err)
+	}
+	_, err = s.createRoleTemplate(rtName,
 		[]rbacv1.PolicyRule{}, []string{}, true, c)
 
 	// create namespace and watchers for resources in that namespace
@@ -290,6 +297,223 @@ func (s *AuthzSuite) TestBuiltinRoleTemplateBindingCreate(c *check.C) {
 	})
 }
 
+func (s *AuthzSuite) TestRoleTemplateRulesUpdate(c *check.C) {
+	projectName := "testproject4"
+
+	rtName := "testrt4"
+	rt, err := s.createRoleTemplate(rtName,
+		[]rbacv1.PolicyRule{
+			{
+				Verbs:           []string{"get"},
+				APIGroups:       []string{""},
+				Resources:       []string{"pods"},
+				ResourceNames:   []string{},
+				NonResourceURLs: []string{},
+			},
+		}, []string{}, false, c)
+	c.Assert(err, check.IsNil)
+
+	ns := setupNS("testauthzns4", projectName, s.clusterClient.CoreV1().Namespaces(), c)
+	defer deleteNSOnPass(ns.Name, s.clusterClient.CoreV1().Namespaces(), c)
+	roleWatcher := s.roleWatcher(c)
+	defer roleWatcher.Stop()
+
+	subject := rbacv1.Subject{
+		Kind: "User",
+		Name: "user1",
+	}
+	binding := s.createPRTBinding("testbinding4", subject, projectName, rtName, c)
+	defer s.ctx.Management.Management.ProjectRoleTemplateBindings("").Delete(binding.Name, &metav1.DeleteOptions{})
+
+	watchChecker(roleWatcher, c, func(watchEvent watch.Event) bool {
+		if role, ok := watchEvent.Object.(*rbacv1.ClusterRole); ok && role.Name == rtName {
+			return watch.Modified == watchEvent.Type || watch.Added == watchEvent.Type
+		}
+		return false
+	})
+
+	// change the rules of the template and assert the role follows
+	rt, err = s.ctx.Management.Management.RoleTemplates("").Get(rtName, metav1.GetOptions{})
+	c.Assert(err, check.IsNil)
+	rt.Rules[0].Verbs = []string{"get", "list", "watch"}
+	rt, err = s.ctx.Management.Management.RoleTemplates("").Update(rt)
+	c.Assert(err, check.IsNil)
+
+	watchChecker(roleWatcher, c, func(watchEvent watch.Event) bool {
+		if role, ok := watchEvent.Object.(*rbacv1.ClusterRole); ok && role.Name == rtName && watch.Modified == watchEvent.Type {
+			return reflect.DeepEqual(role.Rules, rt.Rules)
+		}
+		return false
+	})
+}
+
+// TestAdoptsRoleOfPreviousAgent covers the upgrade from an agent that created roles without the managed label.
+func (s *AuthzSuite) TestAdoptsRoleOfPreviousAgent(c *check.C) {
+	rtName := "testrt6"
+	_, err := s.clusterClient.RbacV1().ClusterRoles().Create(&rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: rtName},
+		Rules: []rbacv1.PolicyRule{
+			{
+				Verbs:     []string{"get"},
+				APIGroups: []string{""},
+				Resources: []string{"pods"},
+			},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	_, err = s.clusterClient.RbacV1().ClusterRoleBindings().Create(&rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "testrt6-previous-agent",
+			Labels: map[string]string{"io.cattle.rtb.owner": "previous-agent-uid"},
+		},
+		Subjects: []rbacv1.Subject{{Kind: "User", Name: "user1"}},
+		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: rtName},
+	})
+	c.Assert(err, check.IsNil)
+
+	roleWatcher := s.roleWatcher(c)
+	defer roleWatcher.Stop()
+
+	rt, err := s.createRoleTemplate(rtName,
+		[]rbacv1.PolicyRule{
+			{
+				Verbs:           []string{"get", "list", "watch"},
+				APIGroups:       []string{""},
+				Resources:       []string{"pods"},
+				ResourceNames:   []string{},
+				NonResourceURLs: []string{},
+			},
+		}, []string{}, false, c)
+	c.Assert(err, check.IsNil)
+
+	subject := rbacv1.Subject{
+		Kind: "User",
+		Name: "user1",
+	}
+	binding := s.createCRTBinding("testcbinding6", subject, rtName, c)
+	defer s.ctx.Management.Management.ClusterRoleTemplateBindings("").Delete(binding.Name, &metav1.DeleteOptions{})
+
+	// assert the role is labelled as managed and follows the template
+	watchChecker(roleWatcher, c, func(watchEvent watch.Event) bool {
+		if role, ok := watchEvent.Object.(*rbacv1.ClusterRole); ok && role.Name == rtName && watch.Modified == watchEvent.Type {
+			return role.Labels["io.cattle.rt.managed"] == "true" && reflect.DeepEqual(role.Rules, rt.Rules)
+		}
+		return false
+	})
+}
+
+func (s *AuthzSuite) TestNamespaceJoinsProject(c *check.C) {
+	projectName := "testproject3"
+
+	rtName := "testrt3"
+	_, err := s.createRoleTemplate(rtName,
+		[]rbacv1.PolicyRule{
+			{
+				Verbs:           []string{"get", "list", "watch"},
+				APIGroups:       []string{""},
+				Resources:       []string{"pods"},
+				ResourceNames:   []string{},
+				NonResourceURLs: []string{},
+			},
+		}, []string{}, false, c)
+	c.Assert(err, check.IsNil)
+
+	// create the binding before any namespace belongs to the project
+	subject := rbacv1.Subject{
+		Kind: "User",
+		Name: "user1",
+	}
+	binding := s.createPRTBinding("testbinding3", subject, projectName, rtName, c)
+	defer s.ctx.Management.Management.ProjectRoleTemplateBindings("").Delete(binding.Name, &metav1.DeleteOptions{})
+
+	// create a namespace outside of the project, then move it into the project
+	ns := setupNS("testauthzns3", "", s.clusterClient.CoreV1().Namespaces(), c)
+	defer deleteNSOnPass(ns.Name, s.clusterClient.CoreV1().Namespaces(), c)
+	bindingWatcher := s.bindingWatcher(ns.Name, c)
+	defer bindingWatcher.Stop()
+
+	ns.Labels["io.cattle.field.projectId"] = projectName
+	ns, err = s.clusterClient.CoreV1().Namespaces().Update(ns)
+	c.Assert(err, check.IsNil)
+
+	watchChecker(bindingWatcher, c, func(watchEvent watch.Event) bool {
+		if watch.Modified == watchEvent.Type || watch.Added == watchEvent.Type {
+			if binding, ok := watchEvent.Object.(*rbacv1.RoleBinding); ok {
+				c.Assert(binding.Subjects[0].Name, check.Equals, subject.Name)
+				c.Assert(binding.RoleRef.Name, check.Equals, rtName)
+				return true
+			}
+		}
+		return false
+	})
+
+	// move the namespace out of the project
+	bindingWatcher.Stop()
+	bindingWatcher = s.bindingWatcher(ns.Name, c)
+
+	ns.Labels["io.cattle.field.projectId"] = "testproject3other"
+	_, err = s.clusterClient.CoreV1().Namespaces().Update(ns)
+	c.Assert(err, check.IsNil)
+
+	watchChecker(bindingWatcher, c, func(watchEvent watch.Event) bool {
+		return watch.Deleted == watchEvent.Type
+	})
+}
+
+func (s *AuthzSuite) TestPodSecurityPolicyTemplateProject(c *check.C) {
+	// create PodSecurityPolicyTemplate
+	psptName := "testpspt1"
+	s.clusterClient.ExtensionsV1beta1().PodSecurityPolicies().Delete(psptName, &metav1.DeleteOptions{})
+	pspt := s.createPodSecurityPolicyTemplate(psptName, c)
+
+	pspWatcher := s.pspWatcher(c)
+	defer pspWatcher.Stop()
+
+	// create project referencing the template and a namespace belonging to it
+	projectName := "testpspproject1"
+	s.createProject(projectName, psptName, c)
+
+	ns := setupNS("testpspns1", projectName, s.clusterClient.CoreV1().Namespaces(), c)
+	defer deleteNSOnPass(ns.Name, s.clusterClient.CoreV1().Namespaces(), c)
+	bindingWatcher := s.bindingWatcher(ns.Name, c)
+	defer bindingWatcher.Stop()
+
+	// assert the policy is created from the template
+	watchChecker(pspWatcher, c, func(watchEvent watch.Event) bool {
+		if watch.Modified == watchEvent.Type || watch.Added == watchEvent.Type {
+			if psp, ok := watchEvent.Object.(*extv1beta1.PodSecurityPolicy); ok && psp.Name == psptName {
+				c.Assert(psp.Spec, check.DeepEquals, pspt.Spec)
+				return true
+			}
+		}
+		return false
+	})
+
+	// assert the namespace's service accounts are allowed to use the policy
+	watchChecker(bindingWatcher, c, func(watchEvent watch.Event) bool {
+		if watch.Modified == watchEvent.Type || watch.Added == watchEvent.Type {
+			if binding, ok := watchEvent.Object.(*rbacv1.RoleBinding); ok {
+				c.Assert(binding.Subjects[0].Kind, check.Equals, "Group")
+				c.Assert(binding.Subjects[0].Name, check.Equals, "system:serviceaccounts:"+ns.Name)
+				c.Assert(binding.RoleRef.Kind, check.Equals, "ClusterRole")
+				return true
+			}
+		}
+		return false
+	})
+
+	// Delete the project
+	bindingWatcher.Stop()
+	bindingWatcher = s.bindingWatcher(ns.Name, c)
+
+	err := s.ctx.Management.Management.Projects("").Delete(projectName, &metav1.DeleteOptions{})
+	c.Assert(err, check.IsNil)
+
+	watchChecker(bindingWatcher, c, func(watchEvent watch.Event) bool {
+		return watch.Deleted == watchEvent.Type
+	})
+}
+
 func (s *AuthzSuite) createCRTBinding(bindingName string, subject rbacv1.Subject, rtName string, c *check.C) *authzv1.ClusterRoleTemplateBinding {
 	binding, err := s.ctx.Management.Management.ClusterRoleTemplateBindings("").Create(&authzv1.ClusterRoleTemplateBinding{
 		TypeMeta: metav1.TypeMeta{
@@ -345,6 +569,46 @@ func (s *AuthzSuite) createRoleTemplate(name string, rules []rbacv1.PolicyRule,
 	return rt, err
 }
 
+func (s *AuthzSuite) createPodSecurityPolicyTemplate(name string, c *check.C) *authzv1.PodSecurityPolicyTemplate {
+	pspt, err := s.ctx.Management.Management.PodSecurityPolicyTemplates("").Create(&authzv1.PodSecurityPolicyTemplate{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PodSecurityPolicyTemplate",
+			APIVersion: "management.cattle.io/v3",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: extv1beta1.PodSecurityPolicySpec{
+			SELinux:            extv1beta1.SELinuxStrategyOptions{Rule: extv1beta1.SELinuxStrategyRunAsAny},
+			RunAsUser:          extv1beta1.RunAsUserStrategyOptions{Rule: extv1beta1.RunAsUserStrategyMustRunAsNonRoot},
+			SupplementalGroups: extv1beta1.SupplementalGroupsStrategyOptions{Rule: extv1beta1.SupplementalGroupsStrategyRunAsAny},
+			FSGroup:            extv1beta1.FSGroupStrategyOptions{Rule: extv1beta1.FSGroupStrategyRunAsAny},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(pspt.Name, check.Equals, name)
+	return pspt
+}
+
+func (s *AuthzSuite) createProject(name, psptName string, c *check.C) *authzv1.Project {
+	project, err := s.ctx.Management.Management.Projects("").Create(&authzv1.Project{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Project",
+			APIVersion: "management.cattle.io/v3",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: authzv1.ProjectSpec{
+			DisplayName:                   name,
+			PodSecurityPolicyTemplateName: psptName,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(project.Name, check.Equals, name)
+	return project
+}
+
 func (s *AuthzSuite) pspWatcher(c *check.C) watch.Interface {
 	pspClient := s.clusterClient.ExtensionsV1beta1().PodSecurityPolicies()
 	pList, err := pspClient.List(metav1.ListOptions{})
@@ -396,10 +660,10 @@ func (s *AuthzSuite) SetUpSuite(c *check.C) {
 	s.ctx = workload
 	s.setupCRDs(c)
 
-	authz.Register(workload)
+	ctx := context.Background()
+	authz.Register(ctx, workload, false)
 
 	go func() {
-		ctx := context.Background()
 		err := workload.StartAndWait(ctx)
 		c.Assert(err, check.IsNil)
 	}()
@@ -429,4 +693,10 @@ func (s *AuthzSuite) setupCRDs(c *check.C) {
 
 	setupCRD("podsecuritypolicytemplate", "podsecuritypolicytemplates", "management.cattle.io", "PodSecurityPolicyTemplates", "v3",
 		apiextensionsv1beta1.ClusterScoped, crdClient, crdWatch, c)
+
+	setupCRD("project", "projects", "management.cattle.io", "Project", "v3",
+		apiextensionsv1beta1.ClusterScoped, crdClient, crdWatch, c)
+
+	setupCRD("cluster", "clusters", "management.cattle.io", "Cluster", "v3",
+		apiextensionsv1beta1.ClusterScoped, crdClient, crdWatch, c)
 }
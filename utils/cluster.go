@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+)
+
+var clusterUpdateBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 10 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// clusterStatusField is a field of the cluster status written by the agent.
+type clusterStatusField struct {
+	path string
+	get  func(cluster *v3.Cluster) interface{}
+}
+
+// agentStatusFields are the status fields the agent owns, the rest of the status belongs to the management plane.
+var agentStatusFields = []clusterStatusField{
+	{path: "/status/conditions", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.Conditions }},
+	{path: "/status/componentStatuses", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.ComponentStatuses }},
+	{path: "/status/capacity", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.Capacity }},
+	{path: "/status/allocatable", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.Allocatable }},
+	{path: "/status/requested", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.Requested }},
+	{path: "/status/limits", get: func(cluster *v3.Cluster) interface{} { return cluster.Status.Limits }},
+}
+
+// UpdateCluster applies mutate to a copy of the cluster and, if mutate reports a change, patches the agent owned fields
+// that differ: the conditions, component statuses and resource totals of the status, and the annotations mutate
+// changed. Changes mutate makes to any other field are not written. The patch only applies to the version of the
+// cluster it was computed from; when the cluster changed in the meantime it is read again and mutate is applied to the
+// fresh copy, so changes made by other writers are kept.
+func UpdateCluster(restClient rest.Interface, clusters v3.ClusterInterface, cluster *v3.Cluster, mutate func(cluster *v3.Cluster) bool) error {
+	err := wait.ExponentialBackoff(clusterUpdateBackoff, func() (bool, error) {
+		updated := cluster.DeepCopy()
+		if !mutate(updated) {
+			return true, nil
+		}
+
+		patch, changed, err := clusterPatch(cluster, updated)
+		if err != nil || !changed {
+			return true, err
+		}
+		err = patchCluster(restClient, cluster.Name, patch)
+		if err == nil {
+			return true, nil
+		}
+
+		latest, getErr := clusters.Get(cluster.Name, metav1.GetOptions{})
+		if getErr != nil || latest.ResourceVersion == cluster.ResourceVersion {
+			return false, errors.Wrapf(err, "couldn't patch cluster %v", cluster.Name)
+		}
+		cluster = latest
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("conflict updating cluster %v", cluster.Name)
+	}
+	return err
+}
+
+// patchOperation is a JSON patch (RFC 6902) operation.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// clusterPatch returns the JSON patch writing the agent owned fields of updated that differ from cluster, and whether
+// there are any.
+func clusterPatch(cluster, updated *v3.Cluster) ([]byte, bool, error) {
+	ops := []patchOperation{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: cluster.ResourceVersion},
+	}
+
+	for _, field := range agentStatusFields {
+		current, desired := field.get(cluster), field.get(updated)
+		if reflect.DeepEqual(current, desired) {
+			continue
+		}
+		// the fields are left out of the object when empty, add creates or replaces them
+		if reflect.ValueOf(desired).Len() > 0 {
+			ops = append(ops, patchOperation{Op: "add", Path: field.path, Value: desired})
+		} else if reflect.ValueOf(current).Len() > 0 {
+			ops = append(ops, patchOperation{Op: "remove", Path: field.path})
+		}
+	}
+
+	if cluster.Annotations == nil && len(updated.Annotations) > 0 {
+		ops = append(ops, patchOperation{Op: "add", Path: "/metadata/annotations", Value: updated.Annotations})
+	} else {
+		for key, value := range updated.Annotations {
+			if currentValue, ok := cluster.Annotations[key]; !ok || currentValue != value {
+				ops = append(ops, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapePathSegment(key), Value: value})
+			}
+		}
+		for key := range cluster.Annotations {
+			if _, ok := updated.Annotations[key]; !ok {
+				ops = append(ops, patchOperation{Op: "remove", Path: "/metadata/annotations/" + escapePathSegment(key)})
+			}
+		}
+	}
+
+	if len(ops) == 1 {
+		return nil, false, nil
+	}
+	patch, err := json.Marshal(ops)
+	return patch, true, err
+}
+
+var pathSegmentEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escapePathSegment escapes a map key for use in a JSON pointer (RFC 6901).
+func escapePathSegment(segment string) string {
+	return pathSegmentEscaper.Replace(segment)
+}
+
+func patchCluster(restClient rest.Interface, name string, patch []byte) error {
+	return restClient.Patch(types.JSONPatchType).
+		Prefix("apis", v3.ClusterGroupVersionKind.Group, v3.ClusterGroupVersionKind.Version).
+		Resource(v3.ClusterResource.Name).
+		Name(name).
+		Body(patch).
+		Do().
+		Error()
+}
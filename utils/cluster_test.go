@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ClusterSuite struct{}
+
+var _ = check.Suite(&ClusterSuite{})
+
+func (s *ClusterSuite) patchOperations(c *check.C, cluster, updated *v3.Cluster) []patchOperation {
+	patch, changed, err := clusterPatch(cluster, updated)
+	c.Assert(err, check.IsNil)
+	if !changed {
+		return nil
+	}
+	// decode the values generically, the way they're sent
+	var ops []patchOperation
+	c.Assert(json.Unmarshal(patch, &ops), check.IsNil)
+	return ops
+}
+
+func (s *ClusterSuite) TestPatchOnlyHasAgentOwnedFields(c *check.C) {
+	cluster := &v3.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "c1",
+			ResourceVersion: "7",
+			Annotations:     map[string]string{"owner/key": "a", "removed": "b"},
+		},
+		Status: v3.ClusterStatus{
+			APIEndpoint: "https://10.0.0.1",
+			Requested:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+		},
+	}
+	updated := cluster.DeepCopy()
+	SetClusterCondition(updated, v3.ClusterConditionReady, v1.ConditionTrue, "", "")
+	updated.Status.Requested = nil
+	updated.Annotations["owner/key"] = "a2"
+	delete(updated.Annotations, "removed")
+	// not owned by the agent, left out of the patch
+	updated.Spec.Description = "changed"
+	updated.Status.APIEndpoint = "https://10.0.0.2"
+
+	ops := s.patchOperations(c, cluster, updated)
+	c.Assert(ops, check.HasLen, 5)
+	c.Assert(ops[0], check.DeepEquals, patchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: "7"})
+	c.Assert(ops[1].Op, check.Equals, "add")
+	c.Assert(ops[1].Path, check.Equals, "/status/conditions")
+	c.Assert(ops[2], check.DeepEquals, patchOperation{Op: "remove", Path: "/status/requested"})
+	c.Assert(ops[3], check.DeepEquals, patchOperation{Op: "add", Path: "/metadata/annotations/owner~1key", Value: "a2"})
+	c.Assert(ops[4], check.DeepEquals, patchOperation{Op: "remove", Path: "/metadata/annotations/removed"})
+}
+
+func (s *ClusterSuite) TestPatchAddsMissingAnnotations(c *check.C) {
+	cluster := &v3.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "c1", ResourceVersion: "7"}}
+	updated := cluster.DeepCopy()
+	updated.Annotations = map[string]string{AgentInfoAnnotation: "{}"}
+
+	ops := s.patchOperations(c, cluster, updated)
+	c.Assert(ops, check.HasLen, 2)
+	c.Assert(ops[1], check.DeepEquals, patchOperation{
+		Op:    "add",
+		Path:  "/metadata/annotations",
+		Value: map[string]interface{}{AgentInfoAnnotation: "{}"},
+	})
+}
+
+func (s *ClusterSuite) TestNoPatchWithoutOwnedChanges(c *check.C) {
+	cluster := &v3.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "c1", ResourceVersion: "7"}}
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "", "")
+	updated := cluster.DeepCopy()
+	updated.Status.APIEndpoint = "https://10.0.0.2"
+
+	c.Assert(s.patchOperations(c, cluster, updated), check.IsNil)
+}
+
+func (s *ClusterSuite) TestEmptyValuesAreSent(c *check.C) {
+	cluster := &v3.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "c1", ResourceVersion: "7", Annotations: map[string]string{}}}
+	updated := cluster.DeepCopy()
+	updated.Annotations["empty"] = ""
+
+	patch, changed, err := clusterPatch(cluster, updated)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, true)
+	c.Assert(string(patch), check.Equals, `[`+
+		`{"op":"test","path":"/metadata/resourceVersion","value":"7"},`+
+		`{"op":"add","path":"/metadata/annotations/empty","value":""}]`)
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// ClusterConditionAgentConnected is kept True by the agent of the cluster, its update time is the agent's last
+	// heartbeat.
+	ClusterConditionAgentConnected v3.ClusterConditionType = "AgentConnected"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+// SetClusterCondition creates or updates the condition of the cluster and reports whether it changed. The transition
+// time moves when the status changes and the update time when the status or reason changes, so writing the same
+// condition again doesn't cause an update of the cluster. ClusterCondition has no message field, so a message is kept
+// in the reason after the short reason, separated by a colon.
+func SetClusterCondition(cluster *v3.Cluster, conditionType v3.ClusterConditionType, status v1.ConditionStatus, reason, message string) bool {
+	if message != "" {
+		if reason != "" {
+			reason = reason + ": " + message
+		} else {
+			reason = message
+		}
+	}
+	currTime := now().UTC().Format(time.RFC3339)
+
+	pos, condition := getClusterConditionByType(cluster, conditionType)
+	if condition == nil {
+		cluster.Status.Conditions = append(cluster.Status.Conditions, v3.ClusterCondition{
+			Type:               conditionType,
+			Status:             status,
+			Reason:             reason,
+			LastUpdateTime:     currTime,
+			LastTransitionTime: currTime,
+		})
+		return true
+	}
+
+	if condition.Status == status && condition.Reason == reason {
+		return false
+	}
+	if condition.Status != status {
+		condition.LastTransitionTime = currTime
+	}
+	condition.Status = status
+	condition.Reason = reason
+	condition.LastUpdateTime = currTime
+	cluster.Status.Conditions[pos] = *condition
+	return true
+}
+
+// TouchClusterCondition moves the update time of the condition if it's older than maxAge and reports whether it did.
+// It's used for heartbeats, which have to be written even when nothing changed.
+func TouchClusterCondition(cluster *v3.Cluster, conditionType v3.ClusterConditionType, maxAge time.Duration) bool {
+	pos, condition := getClusterConditionByType(cluster, conditionType)
+	if condition == nil {
+		return false
+	}
+	lastUpdate, err := time.Parse(time.RFC3339, condition.LastUpdateTime)
+	if err == nil && now().Sub(lastUpdate) < maxAge {
+		return false
+	}
+	condition.LastUpdateTime = now().UTC().Format(time.RFC3339)
+	cluster.Status.Conditions[pos] = *condition
+	return true
+}
+
+// GetClusterCondition returns a copy of the condition of the cluster, or nil if it's not set.
+func GetClusterCondition(cluster *v3.Cluster, conditionType v3.ClusterConditionType) *v3.ClusterCondition {
+	_, condition := getClusterConditionByType(cluster, conditionType)
+	return condition
+}
+
+func getClusterConditionByType(cluster *v3.Cluster, conditionType v3.ClusterConditionType) (int, *v3.ClusterCondition) {
+	for i, condition := range cluster.Status.Conditions {
+		if condition.Type == conditionType {
+			return i, &condition
+		}
+	}
+	return -1, nil
+}
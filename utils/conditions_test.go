@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"gopkg.in/check.v1"
+	"k8s.io/api/core/v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type ConditionsSuite struct {
+	clock time.Time
+}
+
+var _ = check.Suite(&ConditionsSuite{})
+
+func (s *ConditionsSuite) SetUpTest(c *check.C) {
+	s.clock = time.Date(2017, 11, 1, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return s.clock }
+}
+
+func (s *ConditionsSuite) TearDownTest(c *check.C) {
+	now = time.Now
+}
+
+func (s *ConditionsSuite) advance(d time.Duration) string {
+	s.clock = s.clock.Add(d)
+	return s.clock.Format(time.RFC3339)
+}
+
+func (s *ConditionsSuite) TestCreatesMissingCondition(c *check.C) {
+	cluster := &v3.Cluster{}
+	c.Assert(SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "Ready", ""), check.Equals, true)
+
+	c.Assert(cluster.Status.Conditions, check.HasLen, 1)
+	condition := cluster.Status.Conditions[0]
+	c.Assert(condition.Type, check.Equals, v3.ClusterConditionType(v3.ClusterConditionReady))
+	c.Assert(condition.Status, check.Equals, v1.ConditionTrue)
+	c.Assert(condition.Reason, check.Equals, "Ready")
+	c.Assert(condition.LastUpdateTime, check.Equals, "2017-11-01T10:00:00Z")
+	c.Assert(condition.LastTransitionTime, check.Equals, "2017-11-01T10:00:00Z")
+}
+
+func (s *ConditionsSuite) TestUnchangedConditionIsNotUpdated(c *check.C) {
+	cluster := &v3.Cluster{}
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "Ready", "")
+	s.advance(time.Minute)
+
+	c.Assert(SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "Ready", ""), check.Equals, false)
+	c.Assert(cluster.Status.Conditions[0].LastUpdateTime, check.Equals, "2017-11-01T10:00:00Z")
+}
+
+func (s *ConditionsSuite) TestStatusChangeMovesTransitionTime(c *check.C) {
+	cluster := &v3.Cluster{}
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "Ready", "")
+	changed := s.advance(time.Minute)
+
+	c.Assert(SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionFalse, "NotReady", "etcd unhealthy"), check.Equals, true)
+	condition := cluster.Status.Conditions[0]
+	c.Assert(condition.Status, check.Equals, v1.ConditionFalse)
+	c.Assert(condition.Reason, check.Equals, "NotReady: etcd unhealthy")
+	c.Assert(condition.LastUpdateTime, check.Equals, changed)
+	c.Assert(condition.LastTransitionTime, check.Equals, changed)
+}
+
+func (s *ConditionsSuite) TestReasonChangeKeepsTransitionTime(c *check.C) {
+	cluster := &v3.Cluster{}
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionFalse, "NotReady", "etcd unhealthy")
+	changed := s.advance(time.Minute)
+
+	c.Assert(SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionFalse, "NotReady", "no nodes"), check.Equals, true)
+	condition := cluster.Status.Conditions[0]
+	c.Assert(condition.Reason, check.Equals, "NotReady: no nodes")
+	c.Assert(condition.LastUpdateTime, check.Equals, changed)
+	c.Assert(condition.LastTransitionTime, check.Equals, "2017-11-01T10:00:00Z")
+}
+
+func (s *ConditionsSuite) TestMessageWithoutReason(c *check.C) {
+	cluster := &v3.Cluster{}
+	SetClusterCondition(cluster, v3.ClusterConditionNoDiskPressure, v1.ConditionFalse, "", "node1")
+	c.Assert(cluster.Status.Conditions[0].Reason, check.Equals, "node1")
+}
+
+func (s *ConditionsSuite) TestOtherConditionsAreKept(c *check.C) {
+	cluster := &v3.Cluster{}
+	SetClusterCondition(cluster, v3.ClusterConditionProvisioned, v1.ConditionTrue, "", "")
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionTrue, "", "")
+	SetClusterCondition(cluster, v3.ClusterConditionReady, v1.ConditionFalse, "", "")
+
+	c.Assert(cluster.Status.Conditions, check.HasLen, 2)
+	c.Assert(IsClusterProvisioned(cluster), check.Equals, true)
+	c.Assert(GetClusterCondition(cluster, v3.ClusterConditionReady).Status, check.Equals, v1.ConditionFalse)
+}
+
+func (s *ConditionsSuite) TestTouchClusterCondition(c *check.C) {
+	cluster := &v3.Cluster{}
+	c.Assert(TouchClusterCondition(cluster, ClusterConditionAgentConnected, time.Minute), check.Equals, false)
+
+	SetClusterCondition(cluster, ClusterConditionAgentConnected, v1.ConditionTrue, "", "")
+	s.advance(30 * time.Second)
+	c.Assert(TouchClusterCondition(cluster, ClusterConditionAgentConnected, time.Minute), check.Equals, false)
+
+	touched := s.advance(time.Minute)
+	c.Assert(TouchClusterCondition(cluster, ClusterConditionAgentConnected, time.Minute), check.Equals, true)
+	condition := cluster.Status.Conditions[0]
+	c.Assert(condition.LastUpdateTime, check.Equals, touched)
+	c.Assert(condition.LastTransitionTime, check.Equals, "2017-11-01T10:00:00Z")
+}
@@ -5,30 +5,105 @@ import (
 	"time"
 
 	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ClusterNameLabel is set on the objects the agent creates in the management plane to the name of the cluster they
+	// belong to, so agents of different clusters sharing a management plane only ever touch their own objects.
+	ClusterNameLabel = "io.cattle.cluster.name"
+	// AgentInfoAnnotation on a cluster holds the version and settings of the cluster's agent as JSON.
+	AgentInfoAnnotation = "io.cattle.agent.info"
 )
 
 func IsClusterProvisioned(cluster *v3.Cluster) bool {
-	isProvisioned := getClusterConditionByType(cluster, v3.ClusterConditionProvisioned)
+	isProvisioned := GetClusterCondition(cluster, v3.ClusterConditionProvisioned)
 	if isProvisioned == nil {
 		return false
 	}
 	return isProvisioned.Status == "True"
 }
 
-func getClusterConditionByType(cluster *v3.Cluster, conditionType v3.ClusterConditionType) *v3.ClusterCondition {
-	for _, condition := range cluster.Status.Conditions {
-		if condition.Type == conditionType {
-			return &condition
-		}
+type electedKey struct{}
+
+// WithElected returns a context that holds back the loops started with TickerContext and RetryContext until elected is
+// closed, so a replica on standby keeps its caches warm without acting on them.
+func WithElected(ctx context.Context, elected <-chan struct{}) context.Context {
+	return context.WithValue(ctx, electedKey{}, elected)
+}
+
+// WaitForElected blocks until the replica is elected and reports whether it was before the context was done.
+func WaitForElected(ctx context.Context) bool {
+	elected, ok := ctx.Value(electedKey{}).(<-chan struct{})
+	if !ok {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-elected:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return nil
 }
 
+// IsElected reports whether the replica is elected, without waiting. Informer event handlers that act on the cluster
+// check it, they run on replicas on standby too.
+func IsElected(ctx context.Context) bool {
+	elected, ok := ctx.Value(electedKey{}).(<-chan struct{})
+	if !ok {
+		return true
+	}
+	select {
+	case <-elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// TickerContext returns a channel delivering ticks every duration once the replica is elected, until the context is
+// done.
 func TickerContext(ctx context.Context, duration time.Duration) <-chan time.Time {
-	ticker := time.NewTicker(duration)
+	ticks := make(chan time.Time)
 	go func() {
-		<-ctx.Done()
-		ticker.Stop()
+		defer close(ticks)
+		if !WaitForElected(ctx) {
+			return
+		}
+		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				select {
+				case ticks <- t:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
 	}()
-	return ticker.C
+	return ticks
+}
+
+// RetryContext calls f, once the replica is elected, until it succeeds or the context is done, waiting interval between
+// attempts.
+func RetryContext(ctx context.Context, interval time.Duration, name string, f func() error) {
+	if !WaitForElected(ctx) {
+		return
+	}
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		logrus.Warnf("%s failed, retrying in %v: %v", name, interval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
 }
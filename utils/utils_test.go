@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+
+	"gopkg.in/check.v1"
+)
+
+type ElectionSuite struct{}
+
+var _ = check.Suite(&ElectionSuite{})
+
+func (s *ElectionSuite) TestIsElectedWithoutElection(c *check.C) {
+	c.Assert(IsElected(context.Background()), check.Equals, true)
+}
+
+func (s *ElectionSuite) TestIsElectedOnceElected(c *check.C) {
+	elected := make(chan struct{})
+	ctx := WithElected(context.Background(), elected)
+
+	c.Assert(IsElected(ctx), check.Equals, false)
+	close(elected)
+	c.Assert(IsElected(ctx), check.Equals, true)
+}